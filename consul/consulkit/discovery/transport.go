@@ -0,0 +1,250 @@
+// Package discovery resolves service names to healthy instances
+// through Consul, so services can call http://<service-name>/...
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/sync/singleflight"
+)
+
+// Transport is an http.RoundTripper sending requests for
+// http://<service-name>/ to the passing instances of the service.
+// Hosts with a port, a dot or an IP address are not service names
+// and go straight to Base. The zero Transport resolves names through
+// the agent of api.DefaultConfig and does not retry.
+type Transport struct {
+	client *api.Client
+
+	// Base sends the resolved requests, http.DefaultTransport when nil.
+	Base http.RoundTripper
+	// TTL is how long instances are cached, 10s when zero.
+	TTL time.Duration
+	// Retries is how many other instances are tried after a
+	// connection error, DefaultRetries unless changed. Zero
+	// disables retries.
+	Retries int
+
+	mu    sync.Mutex
+	cache map[string]*instances
+	// fetches collapses the concurrent lookups of a service
+	fetches singleflight.Group
+}
+
+type instances struct {
+	addrs   []string
+	fetched time.Time
+	next    int
+}
+
+// DefaultRetries is the Retries of a new Transport.
+const DefaultRetries = 2
+
+// NewTransport creates a transport resolving names with client.
+func NewTransport(client *api.Client) *Transport {
+	return &Transport{
+		client:  client,
+		Retries: DefaultRetries,
+	}
+}
+
+// NewClient returns an http.Client using a discovery Transport.
+func NewClient(client *api.Client) *http.Client {
+	return &http.Client{Transport: NewTransport(client)}
+}
+
+// ErrNoInstances is returned when a service has no passing instance.
+var ErrNoInstances = errors.New("no healthy instances")
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	service := req.URL.Hostname()
+	if !isServiceName(req.URL.Host) {
+		return base.RoundTrip(req)
+	}
+
+	addrs, err := t.resolve(service)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := min(max(t.Retries, 0)+1, len(addrs))
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		out, err := rewrite(req, addrs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := base.RoundTrip(out)
+		if err == nil {
+			return res, nil
+		}
+		lastErr = err
+
+		// The request was canceled, the instance is fine.
+		if req.Context().Err() != nil {
+			break
+		}
+
+		// The instance is likely gone, next requests
+		// should see a fresh list of instances.
+		t.invalidate(service)
+
+		if !retryable(req, err) {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("%s: %w", service, lastErr)
+}
+
+// resolve returns the addresses of service, rotated so that
+// consecutive calls start with a different instance.
+func (t *Transport) resolve(service string) ([]string, error) {
+	t.mu.Lock()
+	cached, ok := t.cache[service]
+	t.mu.Unlock()
+
+	if !ok || time.Since(cached.fetched) > t.ttl() {
+		v, err, _ := t.fetches.Do(service, func() (any, error) {
+			return t.fetch(service)
+		})
+		if err != nil {
+			return nil, err
+		}
+		cached = v.(*instances)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := len(cached.addrs)
+	if n == 0 {
+		return nil, fmt.Errorf("%s: %w", service, ErrNoInstances)
+	}
+
+	start := cached.next % n
+	cached.next++
+
+	return append(cached.addrs[start:n:n], cached.addrs[:start]...), nil
+}
+
+func (t *Transport) ttl() time.Duration {
+	if t.TTL == 0 {
+		return 10 * time.Second
+	}
+	return t.TTL
+}
+
+// fetch asks Consul for the passing instances of service and caches
+// them, unless another lookup just did.
+func (t *Transport) fetch(service string) (*instances, error) {
+	t.mu.Lock()
+	cached, ok := t.cache[service]
+	if ok && time.Since(cached.fetched) <= t.ttl() {
+		t.mu.Unlock()
+		return cached, nil
+	}
+	if t.client == nil {
+		client, err := api.NewClient(api.DefaultConfig())
+		if err != nil {
+			t.mu.Unlock()
+			return nil, fmt.Errorf("failed to resolve %s: %v", service, err)
+		}
+		t.client = client
+	}
+	client := t.client
+	t.mu.Unlock()
+
+	entries, _, err := client.Health().Service(service, "", true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", service, err)
+	}
+
+	cached = &instances{fetched: time.Now()}
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		cached.addrs = append(cached.addrs, net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)))
+	}
+
+	t.mu.Lock()
+	if t.cache == nil {
+		t.cache = map[string]*instances{}
+	}
+	t.cache[service] = cached
+	t.mu.Unlock()
+
+	return cached, nil
+}
+
+func (t *Transport) invalidate(service string) {
+	t.mu.Lock()
+	delete(t.cache, service)
+	t.mu.Unlock()
+}
+
+// rewrite clones req for addr, with a fresh body.
+func rewrite(req *http.Request, addr string) (*http.Request, error) {
+	out := req.Clone(req.Context())
+	out.URL.Host = addr
+	out.Host = ""
+
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+
+	return out, nil
+}
+
+// retryable reports whether req can be sent to another instance.
+// Requests that never reached the instance are always safe to
+// retry, others only when idempotent. Either way the body has
+// to be replayable.
+func retryable(req *http.Request, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isServiceName reports whether host looks like a bare service name.
+func isServiceName(host string) bool {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	return host != "" && host != "localhost" && !strings.Contains(host, ".")
+}
@@ -0,0 +1,180 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeConsul answers health queries with the given instances.
+func fakeConsul(t *testing.T, addrs ...string) *api.Client {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries := []*api.ServiceEntry{}
+		for _, addr := range addrs {
+			host, port, _ := net.SplitHostPort(addr)
+			p, _ := strconv.Atoi(port)
+			entries = append(entries, &api.ServiceEntry{
+				Node:    &api.Node{Address: host},
+				Service: &api.AgentService{Address: host, Port: p},
+			})
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+	t.Cleanup(consul.Close)
+
+	client, err := api.NewClient(&api.Config{Address: consul.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestTransportRetriesOtherInstance(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from ", r.URL.Path)
+	}))
+	defer live.Close()
+
+	// a port nothing listens on anymore
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := ln.Addr().String()
+	ln.Close()
+
+	client := NewClient(fakeConsul(t, dead, live.Listener.Addr().String()))
+
+	for i := 0; i < 4; i++ {
+		res, err := client.Get("http://example-service-2/hello")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if string(body) != "hello from /hello" {
+			t.Errorf("request %d: unexpected body %q", i, body)
+		}
+	}
+}
+
+// failingTransport fails every request like an instance that is gone.
+type failingTransport struct{ attempts int }
+
+func (f *failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	f.attempts++
+	return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+}
+
+func TestTransportRetries(t *testing.T) {
+	consul := fakeConsul(t, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80")
+
+	for retries, want := range map[int]int{0: 1, 1: 2, DefaultRetries: 3} {
+		failing := &failingTransport{}
+		transport := NewTransport(consul)
+		transport.Base = failing
+		transport.Retries = retries
+
+		if _, err := (&http.Client{Transport: transport}).Get("http://example-service-2/"); err == nil {
+			t.Errorf("retries %d: expected an error", retries)
+		}
+		if failing.attempts != want {
+			t.Errorf("retries %d: %d attempts, want %d", retries, failing.attempts, want)
+		}
+	}
+}
+
+func TestTransportStopsOnCanceledRequest(t *testing.T) {
+	consul := fakeConsul(t, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	failing := &failingTransport{}
+	transport := NewTransport(consul)
+	transport.Base = failing
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://example-service-2/", nil)
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("expected an error")
+	}
+	if failing.attempts != 1 {
+		t.Errorf("%d attempts, want 1", failing.attempts)
+	}
+}
+
+func TestTransportCollapsesLookups(t *testing.T) {
+	var lookups atomic.Int32
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode([]*api.ServiceEntry{{
+			Node:    &api.Node{Address: "10.0.0.1"},
+			Service: &api.AgentService{Port: 80},
+		}})
+	}))
+	defer consul.Close()
+	client, _ := api.NewClient(&api.Config{Address: consul.URL})
+	transport := NewTransport(client)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := transport.resolve("example-service-2"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+}
+
+func TestZeroTransport(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Setenv("CONSUL_HTTP_ADDR", ln.Addr().String())
+	ln.Close()
+
+	// no agent listens, the lookup fails without a panic
+	_, err := (&http.Client{Transport: &Transport{}}).Get("http://example-service-2/")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestTransportNoInstances(t *testing.T) {
+	client := NewClient(fakeConsul(t))
+
+	_, err := client.Get("http://example-service-2/hello")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestIsServiceName(t *testing.T) {
+	tests := map[string]bool{
+		"example-service-2": true,
+		"localhost":         false,
+		"api.example.com":   false,
+		"10.0.0.1":          false,
+		"svc:8080":          false,
+	}
+
+	for host, want := range tests {
+		if got := isServiceName(host); got != want {
+			t.Errorf("isServiceName(%q) = %v", host, got)
+		}
+	}
+}
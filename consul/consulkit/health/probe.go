@@ -0,0 +1,105 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Probe checks a single dependency of the service.
+type Probe struct {
+	Name string
+	// Critical probes make the whole service critical when they
+	// fail, the others only degrade it to warning.
+	Critical bool
+	// Timeout bounds Check, defaults to 5s.
+	Timeout time.Duration
+	Check   func(ctx context.Context) error
+}
+
+// Pinger is implemented by *sql.DB and most database clients.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// PingProbe checks a database connection.
+func PingProbe(name string, db Pinger, critical bool) Probe {
+	return Probe{
+		Name:     name,
+		Critical: critical,
+		Check:    db.PingContext,
+	}
+}
+
+// HTTPProbe checks that an upstream answers GET url with a 2xx status.
+func HTTPProbe(name, url string, critical bool) Probe {
+	return Probe{
+		Name:     name,
+		Critical: critical,
+		Check: func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return err
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				return fmt.Errorf("unexpected status %s", res.Status)
+			}
+			return nil
+		},
+	}
+}
+
+// TCPProbe checks that an upstream accepts TCP connections on address.
+func TCPProbe(name, address string, critical bool) Probe {
+	return Probe{
+		Name:     name,
+		Critical: critical,
+		Check: func(ctx context.Context) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", address)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+	}
+}
+
+// run executes the probe within its timeout.
+func (p Probe) run(ctx context.Context) Result {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := p.Check(ctx)
+
+	result := Result{
+		Name:     p.Name,
+		Status:   StatusPassing,
+		Duration: time.Since(start).String(),
+	}
+
+	if err != nil {
+		result.Status = StatusWarning
+		if p.Critical {
+			result.Status = StatusCritical
+		}
+		result.Output = err.Error()
+	}
+
+	return result
+}
@@ -0,0 +1,265 @@
+// Package health reports the health of a service to Consul through
+// a TTL check, computed from a set of dependency probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Statuses, as understood by Consul.
+const (
+	StatusPassing     = api.HealthPassing
+	StatusWarning     = api.HealthWarning
+	StatusCritical    = api.HealthCritical
+	StatusMaintenance = api.HealthMaint
+)
+
+// Result is the outcome of a single probe.
+type Result struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the outcome of a round of probes.
+type Report struct {
+	Status string `json:"status"`
+	// Maintenance is the reason the service is in maintenance.
+	Maintenance string    `json:"maintenance,omitempty"`
+	Checks      []Result  `json:"checks"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// Reporter runs probes on a heartbeat and pushes the
+// aggregated status to a Consul TTL check.
+type Reporter struct {
+	client  *api.Client
+	checkID string
+	probes  []Probe
+
+	mu   sync.RWMutex
+	last Report
+	// critical, when set, is the reason the service
+	// reports critical regardless of its probes.
+	critical string
+	// maintenance, when set, is the reason the
+	// service is in maintenance mode.
+	maintenance string
+	// stopRun stops the loop of Run and runDone is closed once it
+	// returned, so MarkCritical has the last word with Consul.
+	stopRun func()
+	runDone chan struct{}
+}
+
+// NewReporter creates a reporter updating the TTL check checkID.
+// Until the first heartbeat the service reports critical.
+func NewReporter(client *api.Client, checkID string, probes ...Probe) *Reporter {
+	return &Reporter{
+		client:  client,
+		checkID: checkID,
+		probes:  probes,
+		last:    Report{Status: StatusCritical, Checks: []Result{}},
+	}
+}
+
+// Run sends a heartbeat every interval until ctx is done or
+// MarkCritical is called. interval has to be shorter than the
+// TTL of the check.
+func (r *Reporter) Run(ctx context.Context, interval time.Duration) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	r.mu.Lock()
+	if r.critical != "" {
+		r.mu.Unlock()
+		return
+	}
+	r.stopRun, r.runDone = cancel, done
+	r.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.Heartbeat(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Heartbeat runs every probe once and updates the TTL check.
+func (r *Reporter) Heartbeat(ctx context.Context) Report {
+	report := r.probe(ctx)
+	// the TTL check keeps reporting the probes, Consul
+	// tracks maintenance with a check of its own.
+	ttlStatus := report.Status
+
+	r.mu.Lock()
+	if r.maintenance != "" {
+		report.Status = StatusMaintenance
+		report.Maintenance = r.maintenance
+	}
+	r.last = report
+	r.mu.Unlock()
+
+	if ctx.Err() != nil {
+		// Stopped while probing, the probes failed
+		// for that reason and not on their own.
+		return report
+	}
+
+	err := r.client.Agent().UpdateTTL(r.checkID, report.output(), ttlStatus)
+	if err != nil {
+		log.Printf("failed to update TTL check %s: %v", r.checkID, err)
+	}
+
+	return report
+}
+
+// probe runs the probes concurrently, the worst result
+// is the status of the service.
+func (r *Reporter) probe(ctx context.Context) Report {
+	results := make([]Result, len(r.probes))
+
+	var wg sync.WaitGroup
+	for i, p := range r.probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = p.run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	r.mu.RLock()
+	if r.critical != "" {
+		results = append(results, Result{
+			Name:   "service",
+			Status: StatusCritical,
+			Output: r.critical,
+		})
+	}
+	r.mu.RUnlock()
+
+	return Report{
+		Status:    worst(results),
+		Checks:    results,
+		CheckedAt: time.Now(),
+	}
+}
+
+// MarkCritical makes the service critical for good, whatever its
+// probes report, and tells Consul right away. Services call it
+// before shutting down so traffic moves to other instances.
+func (r *Reporter) MarkCritical(ctx context.Context, reason string) Report {
+	r.mu.Lock()
+	r.critical = reason
+	stop, done := r.stopRun, r.runDone
+	r.mu.Unlock()
+
+	// A heartbeat in flight could report passing after
+	// this update, the heartbeats stop for good first.
+	if stop != nil {
+		stop()
+		<-done
+	}
+
+	return r.Heartbeat(ctx)
+}
+
+// SetMaintenance records that the service is in maintenance
+// for reason, an empty reason ends maintenance. Consul itself
+// is told by the maintenance endpoint.
+func (r *Reporter) SetMaintenance(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.maintenance = reason
+	r.last.Maintenance = reason
+
+	switch {
+	case reason != "":
+		r.last.Status = StatusMaintenance
+	case r.last.CheckedAt.IsZero():
+		r.last.Status = StatusCritical
+	case r.last.Status == StatusMaintenance:
+		// back to the probe results until the next heartbeat
+		r.last.Status = worst(r.last.Checks)
+	}
+}
+
+// Last returns the report of the latest heartbeat.
+func (r *Reporter) Last() Report {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.last
+}
+
+// ServeHTTP writes the latest report as JSON. Critical services
+// and services in maintenance answer 503 so plain HTTP checks
+// still work.
+func (r *Reporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.Last()
+
+	code := http.StatusOK
+	if report.Status == StatusCritical || report.Status == StatusMaintenance {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// output summarises the failing probes for the Consul UI.
+func (rep Report) output() string {
+	failing := []string{}
+	for _, result := range rep.Checks {
+		if result.Status != StatusPassing {
+			failing = append(failing, fmt.Sprintf("%s: %s", result.Name, result.Output))
+		}
+	}
+
+	if len(failing) == 0 {
+		return fmt.Sprintf("%d probes passing", len(rep.Checks))
+	}
+	return strings.Join(failing, "\n")
+}
+
+// worst returns the most severe status of results.
+func worst(results []Result) string {
+	status := StatusPassing
+	for _, result := range results {
+		if severity(result.Status) > severity(status) {
+			status = result.Status
+		}
+	}
+	return status
+}
+
+func severity(status string) int {
+	switch status {
+	case StatusPassing:
+		return 0
+	case StatusWarning:
+		return 1
+	}
+	return 2
+}
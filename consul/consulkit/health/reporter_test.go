@@ -0,0 +1,104 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func probe(name string, critical bool, err error) Probe {
+	return Probe{
+		Name:     name,
+		Critical: critical,
+		Check:    func(context.Context) error { return err },
+	}
+}
+
+func TestProbeAggregation(t *testing.T) {
+	down := errors.New("down")
+
+	tests := []struct {
+		probes []Probe
+		want   string
+	}{
+		{[]Probe{probe("db", true, nil), probe("cache", false, nil)}, StatusPassing},
+		{[]Probe{probe("db", true, nil), probe("cache", false, down)}, StatusWarning},
+		{[]Probe{probe("db", true, down), probe("cache", false, down)}, StatusCritical},
+		{nil, StatusPassing},
+	}
+
+	for i, tt := range tests {
+		r := NewReporter(nil, "ttl", tt.probes...)
+		report := r.probe(context.Background())
+
+		if report.Status != tt.want {
+			t.Errorf("%d: status %s, want %s", i, report.Status, tt.want)
+		}
+		if len(report.Checks) != len(tt.probes) {
+			t.Errorf("%d: %d results for %d probes", i, len(report.Checks), len(tt.probes))
+		}
+	}
+}
+
+func TestMarkCriticalIsSticky(t *testing.T) {
+	r := NewReporter(nil, "ttl", probe("db", true, nil))
+	r.critical = "shutting down"
+
+	report := r.probe(context.Background())
+	if report.Status != StatusCritical {
+		t.Errorf("status %s, want critical", report.Status)
+	}
+}
+
+// fakeAgent records the statuses sent to TTL checks.
+func fakeAgent(t *testing.T) (*api.Client, func() []string) {
+	var mu sync.Mutex
+	statuses := []string{}
+
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		update := struct{ Status string }{}
+		json.NewDecoder(r.Body).Decode(&update)
+
+		mu.Lock()
+		statuses = append(statuses, update.Status)
+		mu.Unlock()
+	}))
+	t.Cleanup(consul.Close)
+
+	client, err := api.NewClient(&api.Config{Address: consul.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, statuses...)
+	}
+}
+
+func TestMarkCriticalStopsHeartbeats(t *testing.T) {
+	client, statuses := fakeAgent(t)
+	r := NewReporter(client, "ttl", probe("db", true, nil))
+
+	go r.Run(context.Background(), time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	r.MarkCritical(context.Background(), "shutting down")
+	sent := statuses()
+	time.Sleep(20 * time.Millisecond)
+
+	if len(sent) < 2 || sent[0] != StatusPassing || sent[len(sent)-1] != StatusCritical {
+		t.Fatalf("statuses %v", sent)
+	}
+	if later := statuses()[len(sent):]; len(later) > 0 {
+		t.Errorf("heartbeats went on after MarkCritical: %v", later)
+	}
+}
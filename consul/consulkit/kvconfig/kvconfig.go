@@ -0,0 +1,301 @@
+// Package kvconfig loads a typed configuration from a Consul KV
+// prefix and keeps it up to date with blocking queries.
+//
+// Every key under the prefix is a field of the configuration, nested
+// keys are nested objects. Values of string fields are taken as they
+// are, unless they are a quoted JSON string; the other values are
+// JSON, or plain strings when they do not parse as JSON:
+//
+//	config/example-service/greeting        Hello
+//	config/example-service/limits/requests 100
+//
+// decodes into
+//
+//	{"greeting": "Hello", "limits": {"requests": 100}}
+package kvconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Watcher holds the current configuration of type T.
+type Watcher[T any] struct {
+	client       *api.Client
+	prefix       string
+	fallbackFile string
+
+	mu          sync.RWMutex
+	current     T
+	index       uint64
+	subscribers []func(T)
+}
+
+// New creates a watcher for prefix. fallbackFile, when not empty, is
+// a JSON file read instead of KV when Consul cannot be reached.
+func New[T any](client *api.Client, prefix, fallbackFile string) *Watcher[T] {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &Watcher[T]{
+		client:       client,
+		prefix:       prefix,
+		fallbackFile: fallbackFile,
+	}
+}
+
+// Load reads the configuration once. When Consul is unreachable
+// the fallback file is used instead.
+func (w *Watcher[T]) Load() error {
+	pairs, index, err := w.list(context.Background(), 0)
+	if err == nil {
+		cfg, err := Decode[T](w.prefix, pairs)
+		if err != nil {
+			return err
+		}
+		w.set(cfg, index)
+		return nil
+	}
+
+	if w.fallbackFile == "" {
+		return err
+	}
+	log.Printf("failed to load config from Consul, using %s: %v", w.fallbackFile, err)
+
+	cfg, err := w.readFallback()
+	if err != nil {
+		return err
+	}
+	w.set(cfg, 0)
+
+	return nil
+}
+
+// Get returns the current configuration.
+func (w *Watcher[T]) Get() T {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.current
+}
+
+// Subscribe registers fn to be called with the new configuration
+// each time it changes.
+func (w *Watcher[T]) Subscribe(fn func(T)) {
+	w.mu.Lock()
+	w.subscribers = append(w.subscribers, fn)
+	w.mu.Unlock()
+}
+
+// Watch blocks on the prefix until ctx is done, applying and
+// broadcasting every change. A configuration that fails to
+// decode is logged and skipped until the next change.
+func (w *Watcher[T]) Watch(ctx context.Context) {
+	for ctx.Err() == nil {
+		w.mu.RLock()
+		index := w.index
+		w.mu.RUnlock()
+
+		pairs, next, err := w.list(ctx, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("failed to watch config %s: %v", w.prefix, err)
+				time.Sleep(5 * time.Second)
+			}
+			continue
+		}
+
+		// the index can go backwards, e.g. after a snapshot
+		// restore, start over instead of blocking forever.
+		if next < index {
+			next = 0
+		}
+
+		if next == index {
+			continue
+		}
+
+		cfg, err := Decode[T](w.prefix, pairs)
+		if err != nil {
+			log.Println(err)
+			w.mu.Lock()
+			w.index = next
+			w.mu.Unlock()
+			continue
+		}
+
+		w.set(cfg, next)
+		w.notify(cfg)
+	}
+}
+
+func (w *Watcher[T]) set(cfg T, index uint64) {
+	w.mu.Lock()
+	w.current = cfg
+	w.index = index
+	w.mu.Unlock()
+}
+
+func (w *Watcher[T]) notify(cfg T) {
+	w.mu.RLock()
+	subscribers := append([]func(T){}, w.subscribers...)
+	w.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(cfg)
+	}
+}
+
+func (w *Watcher[T]) list(ctx context.Context, index uint64) (api.KVPairs, uint64, error) {
+	opts := &api.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Minute}
+
+	pairs, meta, err := w.client.KV().List(w.prefix, opts.WithContext(ctx))
+	if err != nil {
+		return nil, index, err
+	}
+
+	return pairs, meta.LastIndex, nil
+}
+
+func (w *Watcher[T]) readFallback() (T, error) {
+	var cfg T
+
+	raw, err := os.ReadFile(w.fallbackFile)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read fallback config: %v", err)
+	}
+
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to decode fallback config: %v", err)
+	}
+
+	return cfg, nil
+}
+
+// Decode turns the pairs under prefix into a T.
+func Decode[T any](prefix string, pairs api.KVPairs) (T, error) {
+	var cfg T
+	tree := map[string]any{}
+
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, prefix)
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue // folders
+		}
+
+		parts := strings.Split(key, "/")
+		value := decodeValue(pair.Value, fieldType(reflect.TypeFor[T](), parts))
+
+		node := tree
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+
+	raw, err := json.Marshal(tree)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to decode config %s: %v", prefix, err)
+	}
+
+	return cfg, nil
+}
+
+// decodeValue returns the JSON form of a KV value decoded into t,
+// t is nil when the configuration has no field for the value.
+func decodeValue(raw []byte, t reflect.Type) any {
+	if t != nil && t.Kind() == reflect.String {
+		// "42" must not become a number.
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s
+		}
+		return string(raw)
+	}
+
+	if json.Valid(raw) {
+		return json.RawMessage(raw)
+	}
+	return string(raw)
+}
+
+// fieldType returns the type of the value at path in t,
+// following JSON names, or nil when there is none.
+func fieldType(t reflect.Type, path []string) reflect.Type {
+	for _, part := range path {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+
+		switch t.Kind() {
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			f, ok := jsonField(t, part)
+			if !ok {
+				return nil
+			}
+			t = f.Type
+		default:
+			return nil
+		}
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// jsonField finds the field of t encoding/json decodes name into:
+// the exact name first, then the first case insensitive match.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	var fold *reflect.StructField
+
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+
+		fieldName := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				fieldName = tagName
+			}
+		}
+
+		if fieldName == name {
+			return f, true
+		}
+		if fold == nil && strings.EqualFold(fieldName, name) {
+			fold = &f
+		}
+	}
+
+	if fold != nil {
+		return *fold, true
+	}
+	return reflect.StructField{}, false
+}
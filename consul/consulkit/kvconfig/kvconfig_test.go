@@ -0,0 +1,47 @@
+package kvconfig
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestDecode(t *testing.T) {
+	type config struct {
+		Greeting string `json:"greeting"`
+		Debug    bool   `json:"debug"`
+		Limits   struct {
+			Requests int `json:"requests"`
+		} `json:"limits"`
+	}
+
+	pairs := api.KVPairs{
+		{Key: "config/svc/"},
+		{Key: "config/svc/greeting", Value: []byte("Hello")},
+		{Key: "config/svc/debug", Value: []byte("true")},
+		{Key: "config/svc/limits/requests", Value: []byte("100")},
+	}
+
+	cfg, err := Decode[config]("config/svc/", pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Greeting != "Hello" || !cfg.Debug || cfg.Limits.Requests != 100 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	// Numbers and quoted strings stay strings in string fields.
+	for raw, want := range map[string]string{`42`: "42", `"quoted"`: "quoted", `{"a":1}`: `{"a":1}`} {
+		pairs := api.KVPairs{{Key: "config/svc/greeting", Value: []byte(raw)}}
+		cfg, err := Decode[config]("config/svc/", pairs)
+		if err != nil || cfg.Greeting != want {
+			t.Errorf("greeting %s: %q %v, want %q", raw, cfg.Greeting, err, want)
+		}
+	}
+
+	bad := api.KVPairs{{Key: "config/svc/debug", Value: []byte("maybe")}}
+	if _, err := Decode[config]("config/svc/", bad); err == nil {
+		t.Error("expected a type error")
+	}
+}
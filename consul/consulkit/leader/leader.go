@@ -0,0 +1,190 @@
+// Package leader elects a single leader among the instances of a
+// service with a Consul lock held through a renewed session.
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Elector campaigns for the lock on Key on behalf of InstanceID.
+type Elector struct {
+	client     *api.Client
+	key        string
+	instanceID string
+	sessionTTL time.Duration
+
+	// OnAcquired runs when the instance becomes leader, ctx is
+	// cancelled as soon as leadership is lost.
+	OnAcquired func(ctx context.Context)
+	// OnLost runs when the instance stops being leader,
+	// once OnAcquired returned.
+	OnLost func()
+
+	mu     sync.RWMutex
+	leader bool
+	since  time.Time
+}
+
+// Status is the leadership state served on /leader.
+type Status struct {
+	Instance string     `json:"instance"`
+	Leader   bool       `json:"leader"`
+	Since    *time.Time `json:"since,omitempty"`
+	// Current is the instance holding the lock, if any.
+	Current string `json:"current_leader,omitempty"`
+}
+
+// retryDelay is the wait before campaigning again after Consul failed.
+var retryDelay = 5 * time.Second
+
+// New creates an elector. The session backing the lock expires
+// sessionTTL after the instance stops renewing it.
+func New(client *api.Client, key, instanceID string, sessionTTL time.Duration) *Elector {
+	return &Elector{
+		client:     client,
+		key:        key,
+		instanceID: instanceID,
+		sessionTTL: sessionTTL,
+	}
+}
+
+// Run campaigns until ctx is done, running for leadership again
+// each time it is lost, or after Consul failed. Leadership is
+// released before returning.
+func (e *Elector) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		lock, err := e.client.LockOpts(&api.LockOptions{
+			Key:            e.key,
+			Value:          []byte(e.instanceID),
+			SessionName:    e.instanceID + " leader election",
+			SessionTTL:     e.sessionTTL.String(),
+			MonitorRetries: 3,
+		})
+		if err != nil {
+			log.Printf("failed to create lock %s: %v", e.key, err)
+			sleep(ctx, retryDelay)
+			continue
+		}
+
+		// Lock renews the session in the background
+		// until the lock is released.
+		lost, err := lock.Lock(ctx.Done())
+		if err != nil {
+			log.Printf("failed to acquire lock %s: %v", e.key, err)
+			sleep(ctx, retryDelay)
+			continue
+		}
+		if lost == nil {
+			return // ctx is done
+		}
+
+		e.lead(ctx, lost)
+
+		if err := lock.Unlock(); err != nil && err != api.ErrLockNotHeld {
+			log.Printf("failed to release lock %s: %v", e.key, err)
+		}
+	}
+}
+
+// lead holds leadership until lost is closed or ctx is done, and
+// returns once OnAcquired did, so that the lock is not released
+// while the leader work still runs.
+func (e *Elector) lead(ctx context.Context, lost <-chan struct{}) {
+	e.setLeader(true)
+	log.Printf("%s acquired leadership of %s", e.instanceID, e.key)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	acquired := make(chan struct{})
+	go func() {
+		defer close(acquired)
+		if e.OnAcquired != nil {
+			e.OnAcquired(leaderCtx)
+		}
+	}()
+
+	select {
+	case <-lost:
+	case <-ctx.Done():
+	}
+	cancel()
+	<-acquired
+
+	e.setLeader(false)
+	log.Printf("%s lost leadership of %s", e.instanceID, e.key)
+
+	if e.OnLost != nil {
+		e.OnLost()
+	}
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.leader = leader
+	e.since = time.Time{}
+	if leader {
+		e.since = time.Now()
+	}
+}
+
+// IsLeader reports whether this instance currently holds the lock.
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+// Status returns the leadership state, looking up the
+// current leader in Consul.
+func (e *Elector) Status() (Status, error) {
+	e.mu.RLock()
+	status := Status{
+		Instance: e.instanceID,
+		Leader:   e.leader,
+	}
+	if e.leader {
+		since := e.since
+		status.Since = &since
+	}
+	e.mu.RUnlock()
+
+	pair, _, err := e.client.KV().Get(e.key, nil)
+	if err != nil {
+		return status, err
+	}
+
+	if pair != nil && pair.Session != "" {
+		status.Current = string(pair.Value)
+	}
+
+	return status, nil
+}
+
+// ServeHTTP writes the leadership status as JSON, or answers
+// 502 when the current leader cannot be read from Consul.
+func (e *Elector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status, err := e.Status()
+	if err != nil {
+		log.Println("failed to read leader:", err)
+		http.Error(w, "failed to read leader", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,355 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeConsul implements the session and KV endpoints used by
+// api.Lock, blocking queries included.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{} // closed on every change
+	sessions map[string]bool
+	pairs    map[string]*api.KVPair
+	nextID   int
+	// failKV makes the KV reads fail.
+	failKV bool
+	// failSessions makes the next session creations fail.
+	failSessions int
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *api.Client) {
+	f := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		sessions: map[string]bool{},
+		pairs:    map[string]*api.KVPair{},
+	}
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	// Runs before srv.Close, ending the blocking queries.
+	t.Cleanup(func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.failKV = true
+		f.bump()
+	})
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, client
+}
+
+// bump records a change. Callers hold f.mu.
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// invalidate destroys a session, releasing its locks.
+func (f *fakeConsul) invalidate(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.destroy(id)
+}
+
+// destroy is invalidate for callers holding f.mu.
+func (f *fakeConsul) destroy(id string) {
+	delete(f.sessions, id)
+	for _, pair := range f.pairs {
+		if pair.Session == id {
+			pair.Session = ""
+		}
+	}
+	f.bump()
+}
+
+func (f *fakeConsul) holder(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pair, ok := f.pairs[key]; ok {
+		return pair.Session
+	}
+	return ""
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := r.URL.Query()
+	path := r.URL.Path
+
+	switch {
+	case path == "/v1/session/create":
+		if f.failSessions > 0 {
+			f.failSessions--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.nextID++
+		id := fmt.Sprintf("session-%d", f.nextID)
+		f.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		id := strings.TrimPrefix(path, "/v1/session/renew/")
+		if !f.sessions[id] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]api.SessionEntry{{ID: id, TTL: "15s"}})
+
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		f.destroy(strings.TrimPrefix(path, "/v1/session/destroy/"))
+		w.Write([]byte("true"))
+
+	case strings.HasPrefix(path, "/v1/kv/") && r.Method == http.MethodGet:
+		f.get(w, r, strings.TrimPrefix(path, "/v1/kv/"))
+
+	case strings.HasPrefix(path, "/v1/kv/") && r.Method == http.MethodPut:
+		key := strings.TrimPrefix(path, "/v1/kv/")
+		pair := f.pairs[key]
+		value, _ := io.ReadAll(r.Body)
+
+		switch {
+		case q.Has("acquire"):
+			session := q.Get("acquire")
+			if !f.sessions[session] || (pair != nil && pair.Session != "" && pair.Session != session) {
+				w.Write([]byte("false"))
+				return
+			}
+			flags, _ := strconv.ParseUint(q.Get("flags"), 10, 64)
+			f.pairs[key] = &api.KVPair{Key: key, Value: value, Flags: flags, Session: session}
+		case q.Has("release"):
+			if pair == nil || pair.Session != q.Get("release") {
+				w.Write([]byte("false"))
+				return
+			}
+			pair.Session = ""
+		}
+		f.bump()
+		w.Write([]byte("true"))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// get answers a KV read, blocking while index is current.
+// Callers hold f.mu.
+func (f *fakeConsul) get(w http.ResponseWriter, r *http.Request, key string) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil {
+		wait = time.Minute
+	}
+	timeout := time.After(wait)
+
+	for index > 0 && index >= f.index && !f.failKV {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+		case <-r.Context().Done():
+		}
+		f.mu.Lock()
+		if r.Context().Err() != nil {
+			return
+		}
+		select {
+		case <-timeout:
+			index = 0
+		default:
+		}
+	}
+
+	if f.failKV {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	pair, ok := f.pairs[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	pair.ModifyIndex = f.index
+	json.NewEncoder(w).Encode([]*api.KVPair{pair})
+}
+
+// events collects the leadership changes of electors in order.
+type events chan string
+
+func (ev events) watch(e *Elector, name string) {
+	e.OnAcquired = func(context.Context) { ev <- name + " acquired" }
+	e.OnLost = func() { ev <- name + " lost" }
+}
+
+func (ev events) expect(t *testing.T, want string) {
+	t.Helper()
+
+	select {
+	case got := <-ev:
+		if got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+const key = "service/test/leader"
+
+func TestElectorAcquireAndLose(t *testing.T) {
+	consul, client := newFakeConsul(t)
+
+	a := New(client, key, "a", 15*time.Second)
+	ev := make(events, 16)
+	ev.watch(a, "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+
+	ev.expect(t, "a acquired")
+	if !a.IsLeader() {
+		t.Error("a is not leader after acquiring")
+	}
+
+	status, err := a.Status()
+	if err != nil || !status.Leader || status.Current != "a" || status.Since == nil {
+		t.Errorf("status %+v, %v", status, err)
+	}
+
+	// The session expires, as when a renewal is missed.
+	consul.invalidate(consul.holder(key))
+	ev.expect(t, "a lost")
+
+	// a campaigns again.
+	ev.expect(t, "a acquired")
+
+	cancel()
+	<-done
+	if a.IsLeader() {
+		t.Error("a is leader after Run returned")
+	}
+	if holder := consul.holder(key); holder != "" {
+		t.Errorf("lock still held by %s", holder)
+	}
+}
+
+func TestElectorHandOver(t *testing.T) {
+	_, client := newFakeConsul(t)
+
+	a := New(client, key, "a", 15*time.Second)
+	b := New(client, key, "b", 15*time.Second)
+	ev := make(events, 16)
+	ev.watch(a, "a")
+	ev.watch(b, "b")
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	go a.Run(ctxA)
+	ev.expect(t, "a acquired")
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go b.Run(ctxB)
+
+	// b waits on the lock while a holds it.
+	time.Sleep(50 * time.Millisecond)
+	if b.IsLeader() {
+		t.Fatal("b leads along with a")
+	}
+
+	cancelA()
+	ev.expect(t, "a lost")
+	ev.expect(t, "b acquired")
+
+	status, err := b.Status()
+	if err != nil || status.Current != "b" {
+		t.Errorf("status %+v, %v", status, err)
+	}
+}
+
+func TestServeHTTPConsulDown(t *testing.T) {
+	consul, client := newFakeConsul(t)
+	consul.mu.Lock()
+	consul.failKV = true
+	consul.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	New(client, key, "a", 15*time.Second).ServeHTTP(w, httptest.NewRequest("GET", "/leader", nil))
+
+	if w.Code != http.StatusBadGateway || strings.TrimSpace(w.Body.String()) != "failed to read leader" {
+		t.Errorf("status %d, body %q", w.Code, w.Body)
+	}
+}
+
+func TestElectorRetriesAfterConsulFailed(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = 10 * time.Millisecond
+
+	consul, client := newFakeConsul(t)
+	consul.mu.Lock()
+	consul.failSessions = 2
+	consul.mu.Unlock()
+
+	a := New(client, key, "a", 15*time.Second)
+	ev := make(events, 16)
+	ev.watch(a, "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	ev.expect(t, "a acquired")
+}
+
+func TestElectorLostAfterLeaderWork(t *testing.T) {
+	consul, client := newFakeConsul(t)
+
+	a := New(client, key, "a", 15*time.Second)
+	ev := make(events, 16)
+	a.OnAcquired = func(ctx context.Context) {
+		ev <- "a acquired"
+		<-ctx.Done()
+		// the work takes a while to stop
+		time.Sleep(50 * time.Millisecond)
+		ev <- "a stopped"
+	}
+	a.OnLost = func() { ev <- "a lost" }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	ev.expect(t, "a acquired")
+	consul.invalidate(consul.holder(key))
+	ev.expect(t, "a stopped")
+	ev.expect(t, "a lost")
+}
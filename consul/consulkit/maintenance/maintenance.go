@@ -0,0 +1,148 @@
+// Package maintenance serves /admin/maintenance, which puts a service
+// instance in Consul maintenance mode so gateways stop routing to it
+// during a deploy.
+package maintenance
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+
+	"consulkit/health"
+)
+
+// Status is the maintenance state of the instance.
+type Status struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Handler toggles maintenance of the service serviceID.
+//
+//	GET  /admin/maintenance                                   current status
+//	POST /admin/maintenance {"enabled": true, "reason": "deploy"}
+//
+// Requests must carry "Authorization: Bearer <token>", the endpoint
+// is disabled when token is empty.
+type Handler struct {
+	client    *api.Client
+	serviceID string
+	token     string
+	reporter  *health.Reporter
+}
+
+// NewHandler creates the endpoint and brings reporter in line with
+// the maintenance state Consul already has for the instance.
+func NewHandler(client *api.Client, serviceID, token string, reporter *health.Reporter) *Handler {
+	h := &Handler{
+		client:    client,
+		serviceID: serviceID,
+		token:     token,
+		reporter:  reporter,
+	}
+
+	status, err := h.status()
+	if err != nil {
+		log.Printf("failed to read maintenance status: %v", err)
+	} else if status.Enabled {
+		reporter.SetMaintenance(status.Reason)
+	}
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		req := Status{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := h.set(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := h.status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *Handler) set(s Status) error {
+	agent := h.client.Agent()
+
+	if !s.Enabled {
+		if err := agent.DisableServiceMaintenance(h.serviceID); err != nil {
+			return err
+		}
+		h.reporter.SetMaintenance("")
+		log.Println("Maintenance disabled")
+		return nil
+	}
+
+	if s.Reason == "" {
+		s.Reason = "maintenance"
+	}
+
+	if err := agent.EnableServiceMaintenance(h.serviceID, s.Reason); err != nil {
+		return err
+	}
+	h.reporter.SetMaintenance(s.Reason)
+	log.Println("Maintenance enabled:", s.Reason)
+
+	return nil
+}
+
+// status reads the maintenance check Consul adds
+// to the service while maintenance is enabled.
+func (h *Handler) status() (Status, error) {
+	checks, err := h.client.Agent().Checks()
+	if err != nil {
+		return Status{}, err
+	}
+
+	check, ok := checks[MaintenanceCheckID(h.serviceID)]
+	if !ok {
+		return Status{}, nil
+	}
+
+	return Status{Enabled: true, Reason: check.Notes}, nil
+}
+
+// MaintenanceCheckID is the ID of the check Consul
+// registers while serviceID is in maintenance.
+func MaintenanceCheckID(serviceID string) string {
+	return "_service_maintenance:" + serviceID
+}
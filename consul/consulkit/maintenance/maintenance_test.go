@@ -0,0 +1,103 @@
+package maintenance
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"consulkit/health"
+)
+
+// fakeAgent keeps the maintenance checks the agent would register.
+func fakeAgent(t *testing.T) *api.Client {
+	var mu sync.Mutex
+	checks := map[string]*api.AgentCheck{}
+
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if id, ok := strings.CutPrefix(r.URL.Path, "/v1/agent/service/maintenance/"); ok {
+			if r.URL.Query().Get("enable") == "true" {
+				checks[MaintenanceCheckID(id)] = &api.AgentCheck{Notes: r.URL.Query().Get("reason")}
+			} else {
+				delete(checks, MaintenanceCheckID(id))
+			}
+			return
+		}
+		json.NewEncoder(w).Encode(checks)
+	}))
+	t.Cleanup(consul.Close)
+
+	client, err := api.NewClient(&api.Config{Address: consul.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestHandler(t *testing.T) {
+	client := fakeAgent(t)
+	reporter := health.NewReporter(client, "ttl")
+	h := NewHandler(client, "web-1", "secret", reporter)
+
+	steps := []struct {
+		method, auth, body string
+		status             int
+		want               Status
+	}{
+		{"GET", "", "", http.StatusUnauthorized, Status{}},
+		{"POST", "Bearer wrong", `{"enabled":true}`, http.StatusUnauthorized, Status{}},
+		{"POST", "secret", `{"enabled":true}`, http.StatusUnauthorized, Status{}},
+		{"GET", "Bearer secret", "", http.StatusOK, Status{}},
+		{"POST", "Bearer secret", `{"enabled":true,"reason":"deploy"}`, http.StatusOK, Status{Enabled: true, Reason: "deploy"}},
+		{"GET", "Bearer secret", "", http.StatusOK, Status{Enabled: true, Reason: "deploy"}},
+		{"PUT", "Bearer secret", `{"enabled":false}`, http.StatusOK, Status{}},
+		{"POST", "Bearer secret", `{`, http.StatusBadRequest, Status{}},
+		{"DELETE", "Bearer secret", "", http.StatusMethodNotAllowed, Status{}},
+	}
+
+	for _, s := range steps {
+		req := httptest.NewRequest(s.method, "/admin/maintenance", strings.NewReader(s.body))
+		if s.auth != "" {
+			req.Header.Set("Authorization", s.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != s.status {
+			t.Errorf("%s %q %s: %d, want %d", s.method, s.auth, s.body, w.Code, s.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		got := Status{}
+		json.NewDecoder(w.Body).Decode(&got)
+		if got != s.want {
+			t.Errorf("%s %s: %+v, want %+v", s.method, s.body, got, s.want)
+		}
+	}
+}
+
+func TestHandlerDisabledWithoutToken(t *testing.T) {
+	client := fakeAgent(t)
+	h := NewHandler(client, "web-1", "", health.NewReporter(client, "ttl"))
+
+	for _, auth := range []string{"", "Bearer ", "Bearer x"} {
+		req := httptest.NewRequest("GET", "/admin/maintenance", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: %d, want 401", auth, w.Code)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package registration
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Config describes a service instance and how Consul checks it.
+type Config struct {
+	ConsulAddress string
+
+	ID      string
+	Name    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+
+	// Checks are added to the registration as is.
+	Checks api.AgentServiceChecks
+	// CheckSpecs are short check descriptions, see ParseCheck.
+	// When both Checks and CheckSpecs are empty the service
+	// gets an HTTP check on /health.
+	CheckSpecs []string
+
+	// DeregisterAfter makes Consul remove the service once a check
+	// has been critical for that long, so instances that crash
+	// without deregistering do not linger.
+	DeregisterAfter time.Duration
+}
+
+// BindFlags registers flags for every field of c on fs. The current
+// values of c are the defaults, environment variables override them
+// and flags override both.
+//
+//	CONSUL_HTTP_ADDR   -consul-addr
+//	SERVICE_ID         -service-id
+//	SERVICE_NAME       -service-name
+//	SERVICE_ADDRESS    -service-address
+//	SERVICE_PORT       -service-port
+//	SERVICE_TAGS       -tags       (a,b,c)
+//	SERVICE_META       -meta       (k=v,k=v)
+//	SERVICE_CHECKS     -checks     (http:/health,tcp,ttl:15s)
+//
+// It returns an error when an environment variable holds an
+// invalid value, rather than falling back on the default.
+func (c *Config) BindFlags(fs *flag.FlagSet) error {
+	if c.ConsulAddress == "" {
+		c.ConsulAddress = "http://localhost:8500"
+	}
+
+	fs.StringVar(&c.ConsulAddress, "consul-addr", envOr("CONSUL_HTTP_ADDR", c.ConsulAddress), "Consul agent address")
+	fs.StringVar(&c.ID, "service-id", envOr("SERVICE_ID", c.ID), "service instance ID")
+	fs.StringVar(&c.Name, "service-name", envOr("SERVICE_NAME", c.Name), "service name")
+	fs.StringVar(&c.Address, "service-address", envOr("SERVICE_ADDRESS", c.Address), "address advertised to Consul")
+
+	port := c.Port
+	if v := os.Getenv("SERVICE_PORT"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid SERVICE_PORT %q: %v", v, err)
+		}
+		port = p
+	}
+	fs.IntVar(&c.Port, "service-port", port, "port the service listens on")
+
+	if v := os.Getenv("SERVICE_TAGS"); v != "" {
+		c.Tags = splitList(v)
+	}
+	fs.Var((*listValue)(&c.Tags), "tags", "comma separated service tags")
+
+	if v := os.Getenv("SERVICE_META"); v != "" {
+		c.Meta = map[string]string{}
+		if err := (*metaValue)(&c.Meta).Set(v); err != nil {
+			return fmt.Errorf("invalid SERVICE_META: %v", err)
+		}
+	}
+	fs.Var((*metaValue)(&c.Meta), "meta", "comma separated key=value service Meta")
+
+	if v := os.Getenv("SERVICE_CHECKS"); v != "" {
+		c.CheckSpecs = splitList(v)
+	}
+	fs.Var((*listValue)(&c.CheckSpecs), "checks", "comma separated checks: http:<path>, tcp, ttl:<duration>")
+
+	return nil
+}
+
+// ParseCheck turns a short check description into a check of
+// the service at address:port. Supported forms:
+//
+//	http:/path      HTTP GET every 10s
+//	tcp             TCP connect every 10s
+//	ttl:15s         TTL the service has to refresh itself
+func ParseCheck(spec, serviceID, address string, port int) (*api.AgentServiceCheck, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+
+	switch kind {
+	case "http":
+		if arg == "" {
+			arg = "/health"
+		}
+		return &api.AgentServiceCheck{
+			Name:     "HTTP " + arg,
+			HTTP:     fmt.Sprintf("http://%s:%d%s", address, port, arg),
+			Interval: "10s",
+			Timeout:  "5s",
+		}, nil
+	case "tcp":
+		return &api.AgentServiceCheck{
+			Name:     "TCP",
+			TCP:      fmt.Sprintf("%s:%d", address, port),
+			Interval: "10s",
+			Timeout:  "5s",
+		}, nil
+	case "ttl":
+		if _, err := time.ParseDuration(arg); err != nil {
+			return nil, fmt.Errorf("invalid ttl check %q: %v", spec, err)
+		}
+		return &api.AgentServiceCheck{
+			CheckID: TTLCheckID(serviceID),
+			Name:    "TTL",
+			TTL:     arg,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown check %q", spec)
+}
+
+// TTLCheckID is the ID of the TTL check registered for serviceID.
+func TTLCheckID(serviceID string) string {
+	return "service:" + serviceID + ":ttl"
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// listValue is a comma separated flag.Value.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = splitList(s)
+	return nil
+}
+
+// metaValue is a comma separated key=value flag.Value.
+type metaValue map[string]string
+
+func (m *metaValue) String() string {
+	if m == nil {
+		return ""
+	}
+	pairs := []string{}
+	for k, v := range *m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metaValue) Set(s string) error {
+	meta := map[string]string{}
+	for _, pair := range splitList(s) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid meta %q, expected key=value", pair)
+		}
+		meta[k] = v
+	}
+	*m = meta
+	return nil
+}
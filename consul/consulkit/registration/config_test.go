@@ -0,0 +1,93 @@
+package registration
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestBindFlags(t *testing.T) {
+	t.Setenv("SERVICE_PORT", "9000")
+	t.Setenv("SERVICE_TAGS", "gateway, internal")
+
+	cfg := Config{ID: "svc-1", Name: "svc", Port: 8080}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := cfg.BindFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	err := fs.Parse([]string{"-service-id", "svc-2", "-meta", "version=2,zone=a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ID != "svc-2" || cfg.Name != "svc" || cfg.Port != 9000 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if len(cfg.Tags) != 2 || cfg.Tags[1] != "internal" {
+		t.Errorf("unexpected tags %v", cfg.Tags)
+	}
+	if cfg.Meta["version"] != "2" || cfg.Meta["zone"] != "a" {
+		t.Errorf("unexpected meta %v", cfg.Meta)
+	}
+}
+
+func TestBindFlagsInvalidEnv(t *testing.T) {
+	for _, env := range [][2]string{
+		{"SERVICE_PORT", "80a"},
+		{"SERVICE_META", "version"},
+	} {
+		t.Run(env[0], func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+
+			cfg := Config{Port: 8080}
+			if err := cfg.BindFlags(flag.NewFlagSet("test", flag.ContinueOnError)); err == nil {
+				t.Errorf("%s=%s accepted, port %d", env[0], env[1], cfg.Port)
+			}
+		})
+	}
+}
+
+func TestChecks(t *testing.T) {
+	cfg := Config{ID: "svc-1", Address: "10.0.0.1", Port: 8080}
+
+	checks, err := cfg.checks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 1 || checks[0].HTTP != "http://10.0.0.1:8080/health" {
+		t.Errorf("unexpected default checks %+v", checks)
+	}
+
+	cfg.CheckSpecs = []string{"tcp", "ttl:15s"}
+	checks, err = cfg.checks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 2 || checks[1].CheckID != TTLCheckID("svc-1") {
+		t.Errorf("unexpected checks %+v", checks)
+	}
+
+	cfg.CheckSpecs = []string{"grpc"}
+	if _, err := cfg.checks(); err == nil {
+		t.Error("expected an error for an unknown check")
+	}
+}
+
+func TestChecksLeaveCallerChecks(t *testing.T) {
+	own := &api.AgentServiceCheck{TCP: "10.0.0.1:9000", Interval: "10s"}
+	cfg := Config{ID: "svc-1", Checks: api.AgentServiceChecks{own}, DeregisterAfter: time.Minute}
+
+	checks, err := cfg.checks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checks[0].DeregisterCriticalServiceAfter != "1m0s" {
+		t.Errorf("default not applied: %+v", checks[0])
+	}
+	if own.DeregisterCriticalServiceAfter != "" {
+		t.Errorf("the caller's check was changed: %+v", own)
+	}
+}
@@ -0,0 +1,142 @@
+// Package registration registers example services with Consul
+// and removes them again when the service shuts down.
+package registration
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Registration is a service instance registered with Consul.
+type Registration struct {
+	client *api.Client
+	config Config
+}
+
+// Register creates a Consul client for cfg.ConsulAddress
+// and registers the service described by cfg.
+func Register(cfg Config) (*Registration, error) {
+	if cfg.ConsulAddress == "" {
+		cfg.ConsulAddress = "http://localhost:8500"
+	}
+
+	client, err := api.NewClient(&api.Config{
+		Address: cfg.ConsulAddress, // Consul address
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %v", err)
+	}
+
+	return RegisterWith(client, cfg)
+}
+
+// RegisterWith registers the service described by cfg using client.
+func RegisterWith(client *api.Client, cfg Config) (*Registration, error) {
+	if cfg.ID == "" {
+		cfg.ID = cfg.Name
+	}
+
+	checks, err := cfg.checks()
+	if err != nil {
+		return nil, err
+	}
+
+	// Define the service registration
+	registration := &api.AgentServiceRegistration{
+		ID:      cfg.ID,
+		Name:    cfg.Name,
+		Address: cfg.Address,
+		Port:    cfg.Port,
+		Tags:    cfg.Tags,
+		Meta:    cfg.Meta,
+		Checks:  checks,
+	}
+
+	// Register the service
+	err = client.Agent().ServiceRegister(registration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register service: %v", err)
+	}
+
+	return &Registration{client: client, config: cfg}, nil
+}
+
+// checks builds the checks of the registration from
+// Checks and CheckSpecs.
+func (c Config) checks() (api.AgentServiceChecks, error) {
+	specs := c.CheckSpecs
+	if len(specs) == 0 && len(c.Checks) == 0 {
+		specs = []string{"http:/health"}
+	}
+
+	// the defaults below are set on copies,
+	// not on the checks of the caller
+	checks := api.AgentServiceChecks{}
+	for _, check := range c.Checks {
+		copied := *check
+		checks = append(checks, &copied)
+	}
+	for _, spec := range specs {
+		check, err := ParseCheck(spec, c.ID, c.Address, c.Port)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+
+	if c.DeregisterAfter > 0 {
+		for _, check := range checks {
+			if check.DeregisterCriticalServiceAfter == "" {
+				check.DeregisterCriticalServiceAfter = c.DeregisterAfter.String()
+			}
+		}
+	}
+
+	return checks, nil
+}
+
+// Client returns the Consul client the service was registered with.
+func (r *Registration) Client() *api.Client {
+	return r.client
+}
+
+// Config returns the configuration the service was registered with.
+func (r *Registration) Config() Config {
+	return r.config
+}
+
+// ID returns the service instance ID.
+func (r *Registration) ID() string {
+	return r.config.ID
+}
+
+// Deregister removes the service from Consul.
+func (r *Registration) Deregister() error {
+	err := r.client.Agent().ServiceDeregister(r.config.ID)
+	if err != nil {
+		return fmt.Errorf("failed to deregister service: %v", err)
+	}
+	return nil
+}
+
+// DeregisterOnSignal blocks until SIGINT or SIGTERM is received,
+// then deregisters the service.
+func (r *Registration) DeregisterOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	// Wait for termination signal
+	<-sigs
+
+	// Deregister the service upon shutdown
+	if err := r.Deregister(); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println("Service deregistered from Consul")
+}
@@ -0,0 +1,140 @@
+// Package service wires what every example service runs next to its
+// Consul registration: a configuration kept in sync with Consul KV, a
+// health reporter feeding the TTL check and the /admin/maintenance
+// endpoint.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"consulkit/health"
+	"consulkit/kvconfig"
+	"consulkit/maintenance"
+	"consulkit/registration"
+)
+
+// HeartbeatInterval is how often the reporter updates the TTL check,
+// well within the ttl:15s check the services register.
+const HeartbeatInterval = 5 * time.Second
+
+// Options are the command line options shared by the services.
+type Options struct {
+	// ConfigPrefix is the Consul KV prefix of the configuration,
+	// config/<service name>/ when empty.
+	ConfigPrefix string
+	// ConfigFile is a JSON configuration used when Consul is unreachable.
+	ConfigFile string
+	// AdminToken is the bearer token of the /admin endpoints, they are
+	// disabled when empty.
+	AdminToken string
+}
+
+// BindFlags registers the options on fs. The admin token defaults to
+// the ADMIN_TOKEN environment variable.
+func (o *Options) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.ConfigPrefix, "config-prefix", o.ConfigPrefix, "Consul KV prefix of the service configuration, defaults to config/<service-name>/")
+	fs.StringVar(&o.ConfigFile, "config-file", o.ConfigFile, "JSON configuration used when Consul is unreachable")
+	fs.StringVar(&o.AdminToken, "admin-token", envOr("ADMIN_TOKEN", o.AdminToken), "bearer token of the /admin endpoints, they are disabled when empty")
+}
+
+// Service is a registered instance along with its configuration
+// of type T, read from Consul KV and applied without a restart.
+type Service[T any] struct {
+	Settings *kvconfig.Watcher[T]
+	Reporter *health.Reporter
+	Admin    *maintenance.Handler
+}
+
+// Start loads the configuration of the service registered as reg and
+// keeps it, and the TTL check of reg, up to date until ctx is done.
+// The reporter always probes the Consul agent, probes are added to it.
+func Start[T any](ctx context.Context, reg *registration.Registration, opts Options, probes ...health.Probe) (*Service[T], error) {
+	cfg := reg.Config()
+	if opts.ConfigPrefix == "" {
+		opts.ConfigPrefix = "config/" + cfg.Name + "/"
+	}
+
+	settings := kvconfig.New[T](reg.Client(), opts.ConfigPrefix, opts.ConfigFile)
+	if err := settings.Load(); err != nil {
+		return nil, err
+	}
+	// Only the names of the changed keys are logged,
+	// values may be secrets.
+	previous := settings.Get()
+	settings.Subscribe(func(c T) {
+		log.Printf("Configuration updated, changed keys: %s", strings.Join(changedKeys(previous, c), ", "))
+		previous = c
+	})
+	go settings.Watch(ctx)
+
+	probes = append([]health.Probe{
+		health.HTTPProbe("consul", cfg.ConsulAddress+"/v1/status/leader", false),
+	}, probes...)
+	reporter := health.NewReporter(reg.Client(), registration.TTLCheckID(reg.ID()), probes...)
+	go reporter.Run(ctx, HeartbeatInterval)
+
+	return &Service[T]{
+		Settings: settings,
+		Reporter: reporter,
+		Admin:    maintenance.NewHandler(reg.Client(), reg.ID(), opts.AdminToken, reporter),
+	}, nil
+}
+
+// Handle serves /health and /admin/maintenance on mux.
+func (s *Service[T]) Handle(mux *http.ServeMux) {
+	mux.Handle("/health", s.Reporter)
+	mux.Handle("/admin/maintenance", s.Admin)
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// changedKeys lists the keys whose values differ between the JSON
+// forms of a and b, nested keys are joined with slashes like KV keys.
+func changedKeys(a, b any) []string {
+	return diffKeys("", jsonObject(a), jsonObject(b))
+}
+
+func jsonObject(v any) map[string]any {
+	m := map[string]any{}
+	if raw, err := json.Marshal(v); err == nil {
+		json.Unmarshal(raw, &m)
+	}
+	return m
+}
+
+func diffKeys(prefix string, a, b map[string]any) []string {
+	keys := []string{}
+	for _, k := range slices.Sorted(maps.Keys(a)) {
+		if _, ok := b[k]; !ok {
+			keys = append(keys, prefix+k)
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(b)) {
+		va, vb := a[k], b[k]
+		na, okA := va.(map[string]any)
+		nb, okB := vb.(map[string]any)
+		switch {
+		case okA && okB:
+			keys = append(keys, diffKeys(prefix+k+"/", na, nb)...)
+		case !reflect.DeepEqual(va, vb):
+			keys = append(keys, prefix+k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
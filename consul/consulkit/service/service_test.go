@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"consulkit/registration"
+)
+
+// fakeConsul serves the configuration of web under config/web/
+// and accepts the registration and check updates.
+func fakeConsul(t *testing.T) *httptest.Server {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/kv/config/web/"):
+			if r.URL.Query().Get("index") != "" {
+				// hold the blocking query until the test is over
+				<-r.Context().Done()
+				return
+			}
+			w.Header().Set("X-Consul-Index", "1")
+			json.NewEncoder(w).Encode(api.KVPairs{{Key: "config/web/greeting", Value: []byte("Hi")}})
+		case r.URL.Path == "/v1/agent/checks":
+			json.NewEncoder(w).Encode(map[string]*api.AgentCheck{})
+		}
+	}))
+	t.Cleanup(consul.Close)
+	return consul
+}
+
+func TestStart(t *testing.T) {
+	consul := fakeConsul(t)
+	reg, err := registration.Register(registration.Config{
+		ConsulAddress: consul.URL,
+		Name:          "web",
+		CheckSpecs:    []string{"ttl:15s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type config struct {
+		Greeting string `json:"greeting"`
+	}
+	svc, err := Start[config](ctx, reg, Options{AdminToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := svc.Settings.Get().Greeting; got != "Hi" {
+		t.Errorf("greeting %q, want Hi from config/web/", got)
+	}
+
+	mux := http.NewServeMux()
+	svc.Handle(mux)
+
+	req := httptest.NewRequest("GET", "/admin/maintenance", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("/admin/maintenance: %d, want 200", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code == http.StatusNotFound {
+		t.Error("/health is not served")
+	}
+
+	report := svc.Reporter.Heartbeat(ctx)
+	if len(report.Checks) != 1 || report.Checks[0].Name != "consul" {
+		t.Errorf("checks %+v, want the consul probe", report.Checks)
+	}
+}
+
+func TestChangedKeys(t *testing.T) {
+	type db struct {
+		Host     string `json:"host"`
+		Password string `json:"password"`
+	}
+	type config struct {
+		Greeting string `json:"greeting"`
+		DB       db     `json:"db"`
+		Extra    *int   `json:"extra,omitempty"`
+	}
+
+	one := 1
+	a := config{Greeting: "Hi", DB: db{Host: "h", Password: "old"}}
+	b := config{Greeting: "Hi", DB: db{Host: "h", Password: "new"}, Extra: &one}
+
+	got := strings.Join(changedKeys(a, b), ",")
+	if got != "db/password,extra" {
+		t.Errorf("changedKeys = %q", got)
+	}
+	if got := changedKeys(a, a); len(got) != 0 {
+		t.Errorf("changedKeys of equal configs = %q", got)
+	}
+}
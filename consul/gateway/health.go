@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// instance identifies a service instance, service IDs
+// are only unique on the node that registered them.
+type instance struct {
+	node, serviceId string
+}
+
+// instanceHealth tracks the service instances that have a critical
+// check, instances in maintenance included, so the gateway stops
+// routing to them.
+type instanceHealth struct {
+	mu sync.RWMutex
+	// critical maps instances to the output of a failing check
+	critical map[instance]string
+}
+
+func newInstanceHealth() *instanceHealth {
+	return &instanceHealth{critical: map[instance]string{}}
+}
+
+// watch follows the state of every check with blocking queries.
+func (h *instanceHealth) watch(client *api.Client) {
+	var index uint64
+
+	for {
+		checks, meta, err := client.Health().State(api.HealthCritical, &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  5 * time.Minute,
+		})
+		if err != nil {
+			log.Println("failed to watch health:", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		index = meta.LastIndex
+
+		h.update(checks)
+	}
+}
+
+// update replaces the critical instances with those of checks.
+func (h *instanceHealth) update(checks api.HealthChecks) {
+	critical := map[instance]string{}
+	for _, check := range checks {
+		if check.ServiceID == "" {
+			continue // node checks
+		}
+		reason := check.Output
+		if reason == "" {
+			reason = check.Notes
+		}
+		critical[instance{check.Node, check.ServiceID}] = check.Name + ": " + reason
+	}
+
+	h.mu.Lock()
+	h.critical = critical
+	h.mu.Unlock()
+}
+
+// available reports whether serviceId on node can receive
+// traffic, with the reason when it cannot.
+func (h *instanceHealth) available(node, serviceId string) (bool, string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	reason, critical := h.critical[instance{node, serviceId}]
+	return !critical, reason
+}
+
+// guard answers 503 instead of calling next while serviceId
+// on node is critical or in maintenance.
+func (h *instanceHealth) guard(node, serviceId string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, reason := h.available(node, serviceId); !ok {
+			log.Printf("not forwarding to %s on %s: %s", serviceId, node, reason)
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestInstanceHealthGuard(t *testing.T) {
+	health := newInstanceHealth()
+	health.update(api.HealthChecks{
+		{Node: "node-a", ServiceID: "web", Name: "Service Maintenance Mode", Notes: "deploy"},
+		{Node: "node-a", Name: "Serf Health Status"}, // node checks are ignored
+	})
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tests := []struct {
+		node, serviceId string
+		want            int
+	}{
+		{"node-a", "web", http.StatusServiceUnavailable},
+		{"node-b", "web", http.StatusOK}, // same service ID on another node
+		{"node-a", "api", http.StatusOK},
+		{"node-a", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		health.guard(test.node, test.serviceId, ok)(w, httptest.NewRequest("GET", "/", nil))
+
+		if w.Code != test.want {
+			t.Errorf("%s on %s: %d, want %d", test.serviceId, test.node, w.Code, test.want)
+		}
+		if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s on %s: no Retry-After", test.serviceId, test.node)
+		}
+	}
+
+	// the instance is back once its check passes
+	health.update(nil)
+	w := httptest.NewRecorder()
+	health.guard("node-a", "web", ok)(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("recovered instance: %d", w.Code)
+	}
+}
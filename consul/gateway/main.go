@@ -1,49 +1,81 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 )
 
 func registerHandler(
+	node string,
 	serviceId string,
 	service *api.AgentService,
+	rules *atomic.Pointer[Rules],
+	health *instanceHealth,
 ) {
 
-	//address := fmt.Sprintf("")
 	pathname := fmt.Sprintf("/%s", serviceId)
 	address := fmt.Sprintf("%s:%v", service.Address, service.Port)
 
 	proxy := &httputil.ReverseProxy{
 		Rewrite: func(r *httputil.ProxyRequest) {
+			rules := r.In.Context().Value(rulesKey{}).(*Rules)
 
 			url := url.URL{
-				Scheme: "http",
-				Host:   address,
-				Path:   strings.TrimPrefix(r.In.URL.Path, pathname),
+				Scheme:   "http",
+				Host:     address,
+				Path:     rules.RewritePath(r.In.URL.Path),
+				RawQuery: r.In.URL.RawQuery,
 			}
 
-			log.Println("forwarding:", url.Path, "-->", url.String())
+			log.Println("forwarding:", r.In.URL.Path, "-->", url.String())
 
 			r.SetXForwarded()
 			r.Out.URL = &url
 
+			rules.Request.Apply(r.Out.Header)
 		},
+		ModifyResponse: func(res *http.Response) error {
+			res.Request.Context().Value(rulesKey{}).(*Rules).Response.Apply(res.Header)
+			return nil
+		},
+	}
+
+	// A request and its response see the same rules,
+	// even when they are reloaded in between.
+	forward := func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), rulesKey{}, rules.Load())
+		proxy.ServeHTTP(w, r.WithContext(ctx))
 	}
 
 	http.HandleFunc(
 		pathname+"/",
-		proxy.ServeHTTP,
+		health.guard(node, serviceId, forward),
 	)
 }
 
+// rulesKey holds the rules of a request in its context.
+type rulesKey struct{}
+
 func main() {
+	addr := flag.String("addr", ":7000", "plain HTTP listen address")
+	tlsAddr := flag.String("tls-addr", "", "HTTPS listen address, HTTPS is disabled when empty")
+	certDir := flag.String("cert-dir", "", "directory of <name>.crt/<name>.key certificate pairs")
+	certKV := flag.String("cert-kv", "", "Consul KV prefix of <name>/cert and <name>/key certificate pairs")
+	redirect := flag.Bool("redirect-https", false, "redirect plain HTTP requests to the HTTPS listener")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long in-flight requests may take to finish on shutdown")
+	flag.Parse()
 
 	consulAddress := "http://localhost:8500"
 
@@ -62,12 +94,41 @@ func main() {
 		log.Fatalf("Failed to fetch filtered services: %v", err)
 	}
 
+	// The services are those of the local agent
+	node, err := client.Agent().NodeName()
+	if err != nil {
+		log.Fatalf("Failed to fetch the agent's node name: %v", err)
+	}
+
+	// Stop routing to instances that are critical or in maintenance
+	health := newInstanceHealth()
+	go health.watch(client)
+
 	// Print the filtered services
 	for serviceId, service := range services {
 
+		loaded, index, err := loadRules(
+			client,
+			serviceId,
+			service,
+			"/"+serviceId,
+			0,
+		)
+		if err != nil {
+			log.Fatalf("Failed to load rules for %s: %v", serviceId, err)
+		}
+
+		// Rule changes in KV apply without a restart
+		rules := &atomic.Pointer[Rules]{}
+		rules.Store(loaded)
+		go watchRules(rules, client, serviceId, service, "/"+serviceId, index)
+
 		registerHandler(
+			node,
 			serviceId,
 			service,
+			rules,
+			health,
 		)
 
 		fmt.Printf("Proxying path: /%s  Address: %s, Port: %d, Tags: %v\n",
@@ -75,5 +136,55 @@ func main() {
 
 	}
 
-	http.ListenAndServe(":7000", nil)
+	upgrades := newUpgradeTracker()
+	servers := []*http.Server{}
+
+	if *tlsAddr != "" {
+		tlsConfig, err := newTLSConfig(client, *certDir, *certKV)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+
+		servers = append(servers, &http.Server{
+			Addr:      *tlsAddr,
+			Handler:   upgrades.Wrap(http.DefaultServeMux),
+			TLSConfig: tlsConfig,
+		})
+	}
+
+	var handler http.Handler = upgrades.Wrap(http.DefaultServeMux)
+	if *tlsAddr != "" && *redirect {
+		handler = redirectToHTTPS(*tlsAddr)
+	}
+
+	servers = append(servers, &http.Server{
+		Addr:    *addr,
+		Handler: handler,
+	})
+
+	for _, srv := range servers {
+		go func() {
+			var err error
+			log.Printf("Listening on %s", srv.Addr)
+			if srv.TLSConfig != nil {
+				// certificates come from TLSConfig.GetCertificate
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to serve on %s: %v", srv.Addr, err)
+			}
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	// Wait for termination signal
+	<-sigs
+
+	log.Printf("Shutting down, draining for up to %s", *drainTimeout)
+	shutdown(servers, upgrades, *drainTimeout)
+	fmt.Println("Gateway stopped")
 }
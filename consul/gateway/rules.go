@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// rulesMetaKey is the service Meta key holding a JSON encoded Rules value.
+// Consul caps Meta values at 512 characters, larger rule sets belong in KV.
+const rulesMetaKey = "gateway-rules"
+
+// rulesKVPrefix is the Consul KV prefix under which per route rules
+// are stored, keyed by service ID.
+const rulesKVPrefix = "gateway/rules/"
+
+// HeaderRules lists the header transformations applied to a message.
+// Rules are applied in the order remove, rename, add. Renames are
+// applied at once: every source is read before a target is written,
+// so that a→b with b→a swaps the two headers.
+type HeaderRules struct {
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+	Rename map[string]string `json:"rename,omitempty"`
+}
+
+// Apply transforms h in place.
+func (hr HeaderRules) Apply(h http.Header) {
+	for _, name := range hr.Remove {
+		h.Del(name)
+	}
+
+	// targets are written in the order of their sources
+	// so that merged headers keep the same value order
+	sources := slices.Sorted(maps.Keys(hr.Rename))
+	values := make([][]string, len(sources))
+	for i, from := range sources {
+		values[i] = h.Values(from)
+		h.Del(from)
+	}
+	for i, from := range sources {
+		for _, v := range values[i] {
+			h.Add(hr.Rename[from], v)
+		}
+	}
+
+	for name, value := range hr.Add {
+		h.Set(name, value)
+	}
+}
+
+// PathRewrite rewrites request paths matching Match into Replace.
+// Replace may reference capture groups of Match with $1, ${name}...
+type PathRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+// Rules describes the transformations applied to traffic
+// flowing through a single gateway route.
+type Rules struct {
+	Request  HeaderRules   `json:"request"`
+	Response HeaderRules   `json:"response"`
+	Rewrite  []PathRewrite `json:"rewrite"`
+}
+
+// defaultRules strips the route prefix from the path,
+// which is what the gateway has always done.
+func defaultRules(pathname string) *Rules {
+	return &Rules{
+		Rewrite: []PathRewrite{
+			{Match: "^" + regexp.QuoteMeta(pathname), Replace: ""},
+		},
+	}
+}
+
+// compile validates the rewrite expressions. Stripping the route
+// prefix comes last, for the paths no custom rule matches.
+func (r *Rules) compile(pathname string) error {
+	r.Rewrite = append(r.Rewrite, defaultRules(pathname).Rewrite...)
+
+	for i := range r.Rewrite {
+		re, err := regexp.Compile(r.Rewrite[i].Match)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite %q: %v", r.Rewrite[i].Match, err)
+		}
+		r.Rewrite[i].re = re
+	}
+
+	return nil
+}
+
+// RewritePath returns path transformed by the first matching
+// rewrite rule, or path unchanged if none match.
+func (r *Rules) RewritePath(path string) string {
+	for _, rw := range r.Rewrite {
+		if rw.re.MatchString(path) {
+			return rw.re.ReplaceAllString(path, rw.Replace)
+		}
+	}
+	return path
+}
+
+// parseRules decodes and compiles a JSON rule set.
+func parseRules(raw []byte, pathname string) (*Rules, error) {
+	rules := &Rules{}
+	if err := json.Unmarshal(raw, rules); err != nil {
+		return nil, fmt.Errorf("failed to decode rules: %v", err)
+	}
+
+	if err := rules.compile(pathname); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// rulesFor builds the rules of a route from its KV pair, nil when it
+// has none. Rules stored in Consul KV take precedence over the ones
+// declared in the service Meta.
+func rulesFor(pair *api.KVPair, service *api.AgentService, pathname string) (*Rules, error) {
+	if pair != nil {
+		return parseRules(pair.Value, pathname)
+	}
+
+	if raw, ok := service.Meta[rulesMetaKey]; ok {
+		return parseRules([]byte(raw), pathname)
+	}
+
+	rules := &Rules{}
+	if err := rules.compile(pathname); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// loadRules looks up the rules of a route, blocking until the KV
+// key of the route changes past waitIndex. It returns the index
+// to wait on for the next change.
+func loadRules(
+	client *api.Client,
+	serviceId string,
+	service *api.AgentService,
+	pathname string,
+	waitIndex uint64,
+) (*Rules, uint64, error) {
+
+	pair, meta, err := client.KV().Get(rulesKVPrefix+serviceId, &api.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  5 * time.Minute,
+	})
+	if err != nil {
+		return nil, waitIndex, fmt.Errorf("failed to read rules from KV: %v", err)
+	}
+
+	rules, err := rulesFor(pair, service, pathname)
+	return rules, meta.LastIndex, err
+}
+
+// waitIndex returns the index of the next blocking query, after one
+// waiting on prev returned last. An index going backwards, after a
+// Consul snapshot restore for instance, starts over from 0.
+func waitIndex(prev, last uint64) uint64 {
+	if last < prev {
+		return 0
+	}
+	return last
+}
+
+// watchRules reloads the rules of a route each time the blocking
+// query reports a change to its KV key. A failed reload keeps the
+// previously loaded rules.
+func watchRules(
+	rules *atomic.Pointer[Rules],
+	client *api.Client,
+	serviceId string,
+	service *api.AgentService,
+	pathname string,
+	index uint64,
+) {
+	for {
+		next, nextIndex, err := loadRules(client, serviceId, service, pathname, index)
+		nextIndex = waitIndex(index, nextIndex)
+		if err != nil {
+			log.Printf("failed to reload rules for %s: %v", serviceId, err)
+			if nextIndex == index {
+				// Consul did not answer, try again.
+				time.Sleep(5 * time.Second)
+			}
+			// Bad rules are kept until the next change
+			// instead of being reloaded over and over.
+			index = nextIndex
+			continue
+		}
+
+		if nextIndex != index {
+			rules.Store(next)
+			log.Printf("reloaded rules for %s", serviceId)
+		}
+		index = nextIndex
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestRewritePath(t *testing.T) {
+	rules, err := parseRules([]byte(`{
+		"rewrite": [
+			{"match": "^/svc/v1/users/([0-9]+)$", "replace": "/api/users/$1"},
+			{"match": "^/svc/v2/(?P<rest>.*)$", "replace": "/${rest}"}
+		]
+	}`), "/svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"/svc/v1/users/42": "/api/users/42",
+		"/svc/v2/health":   "/health",
+		"/svc/health":      "/health", // the prefix is still stripped
+		"/other":           "/other",
+	}
+
+	for in, want := range tests {
+		if got := rules.RewritePath(in); got != want {
+			t.Errorf("RewritePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDefaultRulesTrimPrefix(t *testing.T) {
+	rules, err := parseRules([]byte(`{}`), "/example-service-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rules.RewritePath("/example-service-1/dump_post"); got != "/dump_post" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Secret", "s")
+	h.Set("X-Old", "v")
+
+	HeaderRules{
+		Remove: []string{"X-Secret"},
+		Rename: map[string]string{"X-Old": "X-New"},
+		Add:    map[string]string{"X-Gateway": "consul"},
+	}.Apply(h)
+
+	if h.Get("X-Secret") != "" || h.Get("X-Old") != "" {
+		t.Errorf("headers not removed: %v", h)
+	}
+	if h.Get("X-New") != "v" || h.Get("X-Gateway") != "consul" {
+		t.Errorf("unexpected headers: %v", h)
+	}
+}
+
+func TestHeaderRulesSwappedRenames(t *testing.T) {
+	// the same result whatever the map order
+	for range 20 {
+		h := http.Header{}
+		h.Set("A", "1")
+		h.Set("B", "2")
+		h.Set("C", "3")
+
+		HeaderRules{Rename: map[string]string{"A": "B", "B": "A", "C": "B"}}.Apply(h)
+
+		if a, b := h.Values("A"), h.Values("B"); len(a) != 1 || a[0] != "2" || len(b) != 2 || b[0] != "1" || b[1] != "3" || h.Get("C") != "" {
+			t.Fatalf("unexpected headers: %v", h)
+		}
+	}
+}
+
+func TestWaitIndex(t *testing.T) {
+	tests := []struct{ prev, last, want uint64 }{
+		{0, 1, 1},
+		{5, 5, 5},
+		{5, 9, 9},
+		{9, 5, 0},
+	}
+
+	for _, test := range tests {
+		if got := waitIndex(test.prev, test.last); got != test.want {
+			t.Errorf("waitIndex(%d, %d) = %d, want %d", test.prev, test.last, got, test.want)
+		}
+	}
+}
+
+func TestWatchRules(t *testing.T) {
+	// A fake KV endpoint: the rules change once, at index 2.
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/"+rulesKVPrefix+"svc" {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.URL.Query().Get("index") {
+		case "", "0":
+			w.Header().Set("X-Consul-Index", "1")
+			w.WriteHeader(http.StatusNotFound)
+		case "1":
+			w.Header().Set("X-Consul-Index", "2")
+			json.NewEncoder(w).Encode([]api.KVPair{{
+				Key:   rulesKVPrefix + "svc",
+				Value: []byte(`{"rewrite":[{"match":"^/svc/old$","replace":"/new"}]}`),
+			}})
+		default:
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			w.Header().Set("X-Consul-Index", r.URL.Query().Get("index"))
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer consul.Close()
+
+	client, err := api.NewClient(&api.Config{Address: consul.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := &api.AgentService{}
+	loaded, index, err := loadRules(client, "svc", service, "/svc", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.RewritePath("/svc/old"); got != "/old" {
+		t.Errorf("initial rules: RewritePath = %q, want /old", got)
+	}
+
+	rules := &atomic.Pointer[Rules]{}
+	rules.Store(loaded)
+	go watchRules(rules, client, "svc", service, "/svc", index)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rules.Load().RewritePath("/svc/old") != "/new" {
+		if time.Now().After(deadline) {
+			t.Fatal("the KV change was not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
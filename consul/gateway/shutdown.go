@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// closeGoingAway is the WebSocket status code sent to
+// clients when the gateway shuts down.
+const closeGoingAway = 1001
+
+// closeFrameTimeout bounds the time spent on each client when
+// closing upgraded connections, slow or gone clients get no
+// close frame.
+const closeFrameTimeout = time.Second
+
+// upgradeTracker keeps the connections hijacked by the reverse proxy
+// for protocol upgrades. http.Server.Shutdown does not wait for or
+// close hijacked connections, so the gateway has to do it itself.
+type upgradeTracker struct {
+	mu     sync.Mutex
+	conns  map[*trackedConn]struct{}
+	closed bool // no more upgrades once CloseAll ran
+}
+
+// errShuttingDown refuses the upgrades attempted after CloseAll.
+var errShuttingDown = errors.New("gateway shutting down")
+
+func newUpgradeTracker() *upgradeTracker {
+	return &upgradeTracker{conns: map[*trackedConn]struct{}{}}
+}
+
+// Wrap records the connections hijacked while serving next.
+func (t *upgradeTracker) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&hijackRecorder{ResponseWriter: w, tracker: t}, r)
+	})
+}
+
+// CloseAll sends a close frame to every upgraded client and closes
+// the connection. Clients mid frame, or not reading, are closed
+// without one. Later upgrades are refused.
+func (t *upgradeTracker) CloseAll() {
+	t.mu.Lock()
+	t.closed = true
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.closeGoingAway()
+		}()
+	}
+	wg.Wait()
+
+	log.Printf("closed %d upgraded connections", len(conns))
+}
+
+// add tracks c, unless CloseAll already ran.
+func (t *upgradeTracker) add(c *trackedConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *upgradeTracker) remove(c *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+// hijackRecorder hands out tracked connections when the
+// reverse proxy hijacks the response for an upgrade.
+type hijackRecorder struct {
+	http.ResponseWriter
+	tracker *upgradeTracker
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &trackedConn{Conn: conn, tracker: h.tracker}
+	if !h.tracker.add(c) {
+		// Nothing was written yet, the client sees the
+		// connection close and reconnects elsewhere.
+		conn.Close()
+		return nil, nil, errShuttingDown
+	}
+
+	return c, brw, nil
+}
+
+// Unwrap lets http.ResponseController reach Flush and
+// the other optional methods of the wrapped writer.
+func (h *hijackRecorder) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// trackedConn follows the frames written to an upgraded client, so
+// a close frame is only ever injected between two frames.
+type trackedConn struct {
+	net.Conn
+	tracker *upgradeTracker
+
+	mu      sync.Mutex
+	frames  frameTracker
+	closing bool
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return 0, net.ErrClosed
+	}
+
+	n, err := c.Conn.Write(p)
+	c.frames.consume(p[:n])
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.remove(c)
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) closeGoingAway() {
+	// A Write blocked on a client that does not read holds mu,
+	// the deadline makes it give up.
+	c.Conn.SetWriteDeadline(time.Now().Add(closeFrameTimeout))
+
+	c.mu.Lock()
+	c.closing = true
+	if c.frames.atBoundary() {
+		frame := []byte{0x88, 0x02, 0, 0}
+		binary.BigEndian.PutUint16(frame[2:], closeGoingAway)
+
+		c.Conn.SetWriteDeadline(time.Now().Add(closeFrameTimeout))
+		if _, err := c.Conn.Write(frame); err != nil {
+			log.Println("failed to send close frame:", err)
+		}
+	}
+	c.mu.Unlock()
+
+	c.Close()
+}
+
+// frameTracker parses the headers of a server to client WebSocket
+// stream (RFC 6455 section 5.2) to know where frames end.
+type frameTracker struct {
+	header    []byte
+	remaining uint64
+}
+
+func (f *frameTracker) atBoundary() bool {
+	return f.remaining == 0 && len(f.header) == 0
+}
+
+func (f *frameTracker) consume(p []byte) {
+	for len(p) > 0 {
+		if f.remaining > 0 {
+			n := min(uint64(len(p)), f.remaining)
+			f.remaining -= n
+			p = p[n:]
+			continue
+		}
+
+		f.header = append(f.header, p[0])
+		p = p[1:]
+
+		if payload, ok := parseFrameHeader(f.header); ok {
+			f.remaining = payload
+			f.header = f.header[:0]
+		}
+	}
+}
+
+// parseFrameHeader returns the payload length once h
+// holds a complete frame header.
+func parseFrameHeader(h []byte) (uint64, bool) {
+	if len(h) < 2 {
+		return 0, false
+	}
+
+	size := 2
+	if h[1]&0x80 != 0 {
+		size += 4 // masking key
+	}
+
+	length := uint64(h[1] & 0x7f)
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+
+	if len(h) < size {
+		return 0, false
+	}
+
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(h[2:10])
+	}
+
+	return length, true
+}
+
+// shutdown stops the servers from accepting connections, waits up to
+// timeout for in-flight requests to finish, then closes what is left.
+func shutdown(servers []*http.Server, upgrades *upgradeTracker, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("drain of %s interrupted: %v", srv.Addr, err)
+				srv.Close()
+			}
+		}()
+	}
+
+	// Upgraded connections are not drained by Shutdown, tell their
+	// clients to reconnect elsewhere right away. Upgrades racing
+	// with the listeners closing are refused.
+	upgrades.CloseAll()
+
+	wg.Wait()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFrameTrackerBoundary(t *testing.T) {
+	f := frameTracker{}
+
+	// unmasked text frame "hello", split mid header and mid payload
+	f.consume([]byte{0x81})
+	if f.atBoundary() {
+		t.Fatal("boundary inside header")
+	}
+	f.consume([]byte{0x05, 'h', 'e'})
+	if f.atBoundary() {
+		t.Fatal("boundary inside payload")
+	}
+	f.consume([]byte("llo"))
+	if !f.atBoundary() {
+		t.Fatal("no boundary after frame")
+	}
+
+	// binary frame with a 16 bit extended length of 300 bytes
+	f.consume([]byte{0x82, 126, 0x01, 0x2c})
+	f.consume(make([]byte, 299))
+	if f.atBoundary() {
+		t.Fatal("boundary before last payload byte")
+	}
+	f.consume([]byte{0})
+	if !f.atBoundary() {
+		t.Fatal("no boundary after extended frame")
+	}
+}
+
+func TestUpgradeRefusedAfterCloseAll(t *testing.T) {
+	upgrades := newUpgradeTracker()
+	srv := httptest.NewServer(upgrades.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+		conn.Close()
+	})))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil || res.StatusCode != http.StatusNoContent {
+		t.Fatalf("upgrade before CloseAll: %v %v", res, err)
+	}
+
+	upgrades.CloseAll()
+
+	if _, err := http.Get(srv.URL); err == nil {
+		t.Error("upgrade accepted after CloseAll")
+	}
+}
+
+func TestCloseGoingAwayWithBlockedWrite(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	upgrades := newUpgradeTracker()
+	c := &trackedConn{Conn: server, tracker: upgrades}
+	upgrades.add(c)
+
+	// the client reads the first frame, then stops reading
+	// while the second one is being written
+	written := make(chan error, 1)
+	go func() {
+		c.Write([]byte{0x81, 0x01, 'a'})
+		_, err := c.Write([]byte{0x81, 0x03, 'a', 'b', 'c'})
+		written <- err
+	}()
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		upgrades.CloseAll()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * closeFrameTimeout):
+		t.Fatal("CloseAll blocked on the pending write")
+	}
+	if err := <-written; err == nil {
+		t.Error("the blocked write succeeded")
+	}
+	if _, err := c.Write([]byte{0x81, 0x00}); err == nil {
+		t.Error("write accepted after CloseAll")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// certStore holds the certificates served by the HTTPS listener,
+// indexed by the DNS names they are valid for.
+type certStore struct {
+	mu sync.RWMutex
+	// sources keeps the certificates of each source (directory,
+	// KV) apart so one source reloading does not drop the other.
+	sources map[string][]*tls.Certificate
+	certs   map[string]*tls.Certificate
+	// fallback is served to clients that send no SNI or a name no
+	// certificate matches: the first certificate of the first source
+	// by name, sources list their certificates in a stable order.
+	fallback *tls.Certificate
+	count    int
+}
+
+func newCertStore() *certStore {
+	return &certStore{
+		sources: map[string][]*tls.Certificate{},
+		certs:   map[string]*tls.Certificate{},
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate, picking a
+// certificate from the SNI server name. Exact names win over wildcards.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(hello.ServerName)
+
+	if cert, ok := s.certs[name]; ok {
+		return cert, nil
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.certs["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	if s.fallback != nil {
+		return s.fallback, nil
+	}
+
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// replace swaps the certificates of source at once, so a reload
+// never serves a mix of old and new certificates.
+func (s *certStore) replace(source string, certs []*tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sources[source] = certs
+
+	names := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	index := map[string]*tls.Certificate{}
+	var fallback *tls.Certificate
+	count := 0
+
+	for _, name := range names {
+		for _, cert := range s.sources[name] {
+			count++
+			if fallback == nil {
+				fallback = cert
+			}
+			for _, name := range cert.Leaf.DNSNames {
+				index[strings.ToLower(name)] = cert
+			}
+		}
+	}
+
+	s.certs = index
+	s.fallback = fallback
+	s.count = count
+}
+
+// len returns the number of certificates served, with
+// or without DNS names.
+func (s *certStore) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count
+}
+
+// parseCertificate builds a tls.Certificate from PEM blocks and
+// parses its leaf so the DNS names can be indexed.
+func parseCertificate(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &cert, nil
+}
+
+// loadCertDir reads every <name>.crt / <name>.key pair in dir.
+func loadCertDir(dir string) ([]*tls.Certificate, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*tls.Certificate{}
+	for _, certFile := range matches {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+
+		certPEM, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := parseCertificate(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", certFile, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// loadCertKV reads certificates stored in Consul KV as
+// <prefix><name>/cert and <prefix><name>/key pairs, sorted by name.
+func loadCertKV(client *api.Client, prefix string, waitIndex uint64) ([]*tls.Certificate, uint64, error) {
+	pairs, meta, err := client.KV().List(prefix, &api.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  5 * time.Minute,
+	})
+	if err != nil {
+		return nil, waitIndex, err
+	}
+
+	certPEMs := map[string][]byte{}
+	keyPEMs := map[string][]byte{}
+	for _, pair := range pairs {
+		name := strings.TrimPrefix(pair.Key, prefix)
+		switch {
+		case strings.HasSuffix(name, "/cert"):
+			certPEMs[strings.TrimSuffix(name, "/cert")] = pair.Value
+		case strings.HasSuffix(name, "/key"):
+			keyPEMs[strings.TrimSuffix(name, "/key")] = pair.Value
+		}
+	}
+
+	names := make([]string, 0, len(certPEMs))
+	for name := range certPEMs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	certs := []*tls.Certificate{}
+	for _, name := range names {
+		certPEM := certPEMs[name]
+		keyPEM, ok := keyPEMs[name]
+		if !ok {
+			return nil, meta.LastIndex, fmt.Errorf("%s: missing key", name)
+		}
+
+		cert, err := parseCertificate(certPEM, keyPEM)
+		if err != nil {
+			return nil, meta.LastIndex, fmt.Errorf("%s: %v", name, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, meta.LastIndex, nil
+}
+
+// watchCertDir reloads the certificates of dir every interval.
+// A failed reload keeps the previously loaded certificates.
+func watchCertDir(store *certStore, dir string, interval time.Duration) {
+	for range time.Tick(interval) {
+		certs, err := loadCertDir(dir)
+		if err != nil {
+			log.Println("failed to reload certificates:", err)
+			continue
+		}
+		store.replace("dir", certs)
+	}
+}
+
+// watchCertKV reloads the certificates under prefix each
+// time the blocking query reports a change.
+func watchCertKV(store *certStore, client *api.Client, prefix string, index uint64) {
+	for {
+		certs, next, err := loadCertKV(client, prefix, index)
+		next = waitIndex(index, next)
+		if err != nil {
+			log.Println("failed to reload certificates:", err)
+			if next == index {
+				// Consul did not answer, try again.
+				time.Sleep(5 * time.Second)
+			}
+			// A bad pair is kept until the next change
+			// instead of being reloaded over and over.
+			index = next
+			continue
+		}
+
+		if next != index {
+			store.replace("kv", certs)
+			log.Printf("reloaded %d certificates from KV", len(certs))
+		}
+		index = next
+	}
+}
+
+// redirectToHTTPS sends plain HTTP clients to the same URL on the
+// HTTPS listener.
+func redirectToHTTPS(tlsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		// JoinHostPort brackets IPv6 literals itself
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+		switch {
+		case port != "" && port != "443":
+			host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	}
+}
+
+// newTLSConfig loads the initial certificates from certDir and/or the
+// certKV prefix and keeps them up to date in the background.
+func newTLSConfig(client *api.Client, certDir, certKV string) (*tls.Config, error) {
+	store := newCertStore()
+
+	if certDir != "" {
+		certs, err := loadCertDir(certDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificates from %s: %v", certDir, err)
+		}
+		store.replace("dir", certs)
+
+		go watchCertDir(store, certDir, 30*time.Second)
+	}
+
+	if certKV != "" {
+		certs, index, err := loadCertKV(client, certKV, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificates from KV: %v", err)
+		}
+		store.replace("kv", certs)
+
+		go watchCertKV(store, client, certKV, index)
+	}
+
+	if store.len() == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
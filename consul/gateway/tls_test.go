@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// newTestCert returns a self signed certificate for names,
+// its common name is cn.
+func newTestCert(t *testing.T, cn string, names ...string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := parseCertificate(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertStoreGetCertificate(t *testing.T) {
+	bare := newTestCert(t, "bare")
+	exact := newTestCert(t, "exact", "api.example.com")
+	wildcard := newTestCert(t, "wildcard", "*.example.com")
+	other := newTestCert(t, "other", "other.test")
+
+	store := newCertStore()
+	store.replace("kv", []*tls.Certificate{other})
+	store.replace("dir", []*tls.Certificate{bare, exact, wildcard})
+
+	tests := []struct {
+		serverName string
+		want       *tls.Certificate
+	}{
+		{"api.example.com", exact},
+		{"API.Example.com", exact},
+		{"www.example.com", wildcard},
+		{"a.b.example.com", bare}, // wildcards cover a single label
+		{"example.com", bare},
+		{"other.test", other},
+		{"", bare},
+	}
+
+	for _, test := range tests {
+		got, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Errorf("%q: %v", test.serverName, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %s, want %s", test.serverName, got.Leaf.Subject.CommonName, test.want.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestCertStoreReplace(t *testing.T) {
+	old := newTestCert(t, "old", "api.example.com")
+	renewed := newTestCert(t, "renewed", "api.example.com")
+	kv := newTestCert(t, "kv", "kv.example.com")
+
+	store := newCertStore()
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("empty store served a certificate")
+	}
+
+	store.replace("dir", []*tls.Certificate{old})
+	store.replace("kv", []*tls.Certificate{kv})
+	store.replace("dir", []*tls.Certificate{renewed})
+
+	for name, want := range map[string]*tls.Certificate{
+		"api.example.com": renewed,
+		"kv.example.com":  kv, // untouched by the reload of dir
+	} {
+		if got, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); got != want {
+			t.Errorf("%s: got %s", name, got.Leaf.Subject.CommonName)
+		}
+	}
+
+	// A certificate without DNS names is still served.
+	store = newCertStore()
+	store.replace("dir", []*tls.Certificate{newTestCert(t, "bare")})
+	if store.len() != 1 {
+		t.Errorf("len %d, want 1", store.len())
+	}
+}
+
+func TestWatchCertKVIndexReset(t *testing.T) {
+	// The index goes back from 5 to 3, as after a snapshot restore.
+	reset := make(chan struct{}, 1)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "5":
+			w.Header().Set("X-Consul-Index", "3")
+		case "":
+			select {
+			case reset <- struct{}{}:
+			default:
+			}
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			w.Header().Set("X-Consul-Index", "3")
+		default:
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			w.Header().Set("X-Consul-Index", r.URL.Query().Get("index"))
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer consul.Close()
+
+	client, err := api.NewClient(&api.Config{Address: consul.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go watchCertKV(newCertStore(), client, "certs/", 5)
+
+	select {
+	case <-reset:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch did not start over from index 0")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		tlsAddr, host, uri, want string
+	}{
+		{":443", "example.com", "/a?b=c", "https://example.com/a?b=c"},
+		{":443", "example.com:80", "/", "https://example.com/"},
+		{":8443", "example.com:8080", "/a", "https://example.com:8443/a"},
+		{"0.0.0.0:8443", "[::1]:8080", "/", "https://[::1]:8443/"},
+		{":8443", "[::1]", "/", "https://[::1]:8443/"},
+		{":443", "[::1]:80", "/a", "https://[::1]/a"},
+		{":443", "[::1]", "/", "https://[::1]/"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.uri, nil)
+		req.Host = test.host
+		w := httptest.NewRecorder()
+
+		redirectToHTTPS(test.tlsAddr)(w, req)
+
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != test.want {
+			t.Errorf("%s%s: %d %q, want %q", test.host, test.uri, w.Code, w.Header().Get("Location"), test.want)
+		}
+	}
+}
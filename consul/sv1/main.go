@@ -1,97 +1,128 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
-	"github.com/hashicorp/consul/api"
+	"consulkit/discovery"
+	"consulkit/leader"
+	"consulkit/registration"
+	"consulkit/service"
 )
 
+// serviceConfig holds the greeting of /hello.
+type serviceConfig struct {
+	Greeting string `json:"greeting"`
+}
+
 func main() {
-	// Service configuration
-	serviceID := "example-service-1"
-	serviceName := "example-service"
-	servicePort := 8080
-	serviceAddress := "127.0.0.1"
-	consulAddress := "http://localhost:8500"
-
-	config := &api.Config{
-		Address: consulAddress, // Consul address
+	// Service configuration, overridable from env and flags
+	cfg := registration.Config{
+		ID:      "example-service-1",
+		Name:    "example-service",
+		Address: "127.0.0.1",
+		Port:    8080,
+		// heartbeats come from the health reporter
+		CheckSpecs: []string{"ttl:15s"},
 	}
-
-	client, err := api.NewClient(config)
-	if err != nil {
-		log.Fatalf("Failed to create Consul client: %v", err)
+	if err := cfg.BindFlags(flag.CommandLine); err != nil {
+		log.Fatalf("Invalid service configuration: %v", err)
 	}
-
-	// Start a simple HTTP server
-	go startHTTPServer(servicePort)
+	var opts service.Options
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
 
 	// Register the service with Consul
-	err = registerServiceWithConsul(
-		serviceID, serviceName, serviceAddress, servicePort, client)
+	reg, err := registration.Register(cfg)
 	if err != nil {
 		log.Fatalf("Failed to register service with Consul: %v", err)
 	}
 
-	fmt.Printf("Service %s is running on %s:%d and registered with Consul.\n", serviceName, serviceAddress, servicePort)
+	svc, err := service.Start[serviceConfig](context.Background(), reg, opts)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// Only the leader among the instances runs the scheduled jobs
+	elector := leader.New(reg.Client(), "service/"+cfg.Name+"/leader", reg.ID(), 15*time.Second)
+	elector.OnAcquired = runScheduledJobs
+	elector.OnLost = func() {
+		log.Println("Scheduled jobs stopped")
+	}
 
-	// Wait for termination signal
-	<-sigs
+	ctx, cancel := context.WithCancel(context.Background())
+	elected := make(chan struct{})
+	go func() {
+		elector.Run(ctx)
+		close(elected)
+	}()
 
-	// Deregister the service upon shutdown
-	err = client.Agent().ServiceDeregister(serviceID)
-	if err != nil {
-		log.Fatalf("Failed to deregister service: %v", err)
-	}
-	fmt.Println("Service deregistered from Consul")
+	// Peers are addressed by service name, e.g. http://example-service-2/
+	peers := discovery.NewClient(reg.Client())
+	peers.Timeout = 5 * time.Second
 
-}
+	// Start a simple HTTP server
+	go startHTTPServer(cfg.Port, svc, elector, peers)
 
-// registerServiceWithConsul registers the service with Consul
-func registerServiceWithConsul(
-	serviceID,
-	serviceName,
-	serviceAddress string,
-	servicePort int,
-	consulClient *api.Client,
-) error {
-	// Create a Consul client
-
-	// Define the service registration
-	registration := &api.AgentServiceRegistration{
-		ID:      serviceID,
-		Name:    serviceName,
-		Address: serviceAddress,
-		Port:    servicePort,
-		Check: &api.AgentServiceCheck{
-			HTTP:     fmt.Sprintf("http://%s:%d/health", serviceAddress, servicePort),
-			Interval: "10s",
-			Timeout:  "5s",
-		},
-	}
+	fmt.Printf("Service %s is running on %s:%d and registered with Consul.\n", cfg.Name, cfg.Address, cfg.Port)
 
-	// Register the service
-	err := consulClient.Agent().ServiceRegister(registration)
-	if err != nil {
-		return fmt.Errorf("failed to register service: %v", err)
-	}
+	// Wait for termination signal, then deregister
+	reg.DeregisterOnSignal()
 
-	return nil
+	// Hand leadership over to another instance
+	cancel()
+	<-elected
+}
+
+// runScheduledJobs runs the periodic work of the service
+// until ctx is cancelled, i.e. until leadership is lost.
+func runScheduledJobs(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			log.Println("Running scheduled job at", t.Format(time.RFC3339))
+		}
+	}
 }
 
 // startHTTPServer starts a simple HTTP server with a health check endpoint
-func startHTTPServer(port int) {
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "OK")
+func startHTTPServer(
+	port int,
+	svc *service.Service[serviceConfig],
+	elector *leader.Elector,
+	peers *http.Client,
+) {
+	svc.Handle(http.DefaultServeMux)
+	http.Handle("/leader", elector)
+
+	// /peer relays the greeting of example-service-2
+	http.HandleFunc("/peer", func(w http.ResponseWriter, r *http.Request) {
+		res, err := peers.Get("http://example-service-2/hello")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+	})
+	http.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		greeting := svc.Settings.Get().Greeting
+		if greeting == "" {
+			greeting = "Hello"
+		}
+		fmt.Fprintln(w, greeting)
 	})
 
 	log.Printf("Starting HTTP server on :%d...\n", port)
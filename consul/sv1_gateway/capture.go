@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"consulsv1/har"
+)
+
+// redacted replaces the value of sensitive headers and query
+// parameters in captures.
+const redacted = "REDACTED"
+
+// captureRules decide which requests are captured and which
+// headers and query parameters are hidden from the capture file.
+type captureRules struct {
+	// methods to capture, all when empty
+	methods map[string]bool
+	// path must match for a request to be captured, all when nil
+	path *regexp.Regexp
+	// redact holds canonical header names
+	redact map[string]bool
+	// redactQuery holds lower case query parameter names
+	redactQuery map[string]bool
+	// maxBody caps the bodies read and captured, 0 means no limit
+	maxBody int
+}
+
+func newCaptureRules(methods, path, redact, redactQuery string, maxBody int) (captureRules, error) {
+	rules := captureRules{
+		methods:     map[string]bool{},
+		redact:      map[string]bool{},
+		redactQuery: map[string]bool{},
+		maxBody:     maxBody,
+	}
+
+	for _, m := range strings.Split(methods, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			rules.methods[strings.ToUpper(m)] = true
+		}
+	}
+
+	for _, h := range strings.Split(redact, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			rules.redact[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	for _, q := range strings.Split(redactQuery, ",") {
+		if q = strings.TrimSpace(q); q != "" {
+			rules.redactQuery[strings.ToLower(q)] = true
+		}
+	}
+
+	if path != "" {
+		re, err := regexp.Compile(path)
+		if err != nil {
+			return rules, err
+		}
+		rules.path = re
+	}
+
+	return rules, nil
+}
+
+func (c captureRules) match(r *http.Request) bool {
+	if len(c.methods) > 0 && !c.methods[r.Method] {
+		return false
+	}
+	return c.path == nil || c.path.MatchString(r.URL.Path)
+}
+
+// headers converts h to HAR pairs with sensitive values redacted.
+func (c captureRules) headers(h http.Header) []har.NameValue {
+	pairs := har.Headers(h)
+	for i := range pairs {
+		if c.redact[http.CanonicalHeaderKey(pairs[i].Name)] {
+			pairs[i].Value = redacted
+		}
+	}
+	return pairs
+}
+
+// limit wraps r so that no more than the bytes captured, plus one
+// telling a cut body apart, are read from it.
+func (c captureRules) limit(r io.Reader) io.Reader {
+	if c.maxBody <= 0 {
+		return r
+	}
+	return io.LimitReader(r, int64(c.maxBody)+1)
+}
+
+// cut reports whether raw, read through limit, is longer than maxBody.
+func (c captureRules) cut(raw []byte) bool {
+	return c.maxBody > 0 && len(raw) > c.maxBody
+}
+
+// body returns the captured part of a body, base64 encoded when it
+// is not UTF-8 text, and whether it was cut at maxBody. raw may end
+// in the middle of a rune when it was read through limit.
+func (c captureRules) body(raw []byte) (text, encoding string, truncated bool) {
+	if c.cut(raw) {
+		cut := c.maxBody
+		// keep the text valid by not splitting a rune
+		for cut > 0 && cut > c.maxBody-utf8.UTFMax && !utf8.RuneStart(raw[cut]) {
+			cut--
+		}
+		if utf8.Valid(raw[:cut]) {
+			return string(raw[:cut]), "", true
+		}
+		return base64.StdEncoding.EncodeToString(raw[:c.maxBody]), har.Base64, true
+	}
+
+	if !utf8.Valid(raw) {
+		return base64.StdEncoding.EncodeToString(raw), har.Base64, false
+	}
+	return string(raw), "", false
+}
+
+// responseRecorder keeps a copy of the start of what the handler
+// writes, up to limit bytes when limit is positive.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	limit  int
+	body   bytes.Buffer
+	// size counts every byte written
+	size int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	keep := p
+	if r.limit > 0 {
+		keep = p[:min(len(p), max(r.limit-r.body.Len(), 0))]
+	}
+	r.body.Write(keep)
+	r.size += len(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// captureRequests records the requests matching rules, along with
+// their responses, as HAR entries written by w.
+func captureRequests(w *har.Writer, rules captureRules, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !rules.match(r) {
+			next(rw, r)
+			return
+		}
+
+		body, err := io.ReadAll(rules.limit(r.Body))
+		if err != nil {
+			http.Error(rw, "Unable to read request body", http.StatusInternalServerError)
+			return
+		}
+		bodySize := len(body)
+		if rules.cut(body) {
+			// -1, unknown, when the request is chunked
+			bodySize = int(r.ContentLength)
+		}
+		// let the handler read the whole body again
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+		// one byte more than captured marks the body as cut
+		rec := &responseRecorder{ResponseWriter: rw, status: http.StatusOK}
+		if rules.maxBody > 0 {
+			rec.limit = rules.maxBody + 1
+		}
+		start := time.Now()
+		next(rec, r)
+		elapsed := float64(time.Since(start).Microseconds()) / 1000
+
+		entry := har.Entry{
+			StartedDateTime: start,
+			Time:            elapsed,
+			Request: har.Request{
+				Method:      r.Method,
+				URL:         rules.url(r),
+				HTTPVersion: r.Proto,
+				Cookies:     []har.NameValue{},
+				Headers:     rules.headers(r.Header),
+				QueryString: rules.queryString(r),
+				HeadersSize: -1,
+				BodySize:    bodySize,
+			},
+			Response: har.Response{
+				Status:      rec.status,
+				StatusText:  http.StatusText(rec.status),
+				HTTPVersion: r.Proto,
+				Cookies:     []har.NameValue{},
+				Headers:     rules.headers(rec.Header()),
+				Content: har.Content{
+					Size:     rec.size,
+					MimeType: rec.Header().Get("Content-Type"),
+				},
+				HeadersSize: -1,
+				BodySize:    rec.size,
+			},
+			Timings: har.Timings{Wait: elapsed},
+		}
+
+		content := &entry.Response.Content
+		content.Text, content.Encoding, content.Truncated = rules.body(rec.body.Bytes())
+
+		if len(body) > 0 {
+			post := &har.PostData{MimeType: r.Header.Get("Content-Type")}
+			post.Text, post.Encoding, post.Truncated = rules.body(body)
+			entry.Request.PostData = post
+		}
+
+		if err := w.Add(entry); err != nil {
+			log.Println("Error writing capture:", err)
+		}
+	}
+}
+
+// url returns the URL of r with sensitive query values redacted.
+func (c captureRules) url(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	u := *r.URL
+	if query, ok := c.query(r); ok {
+		u.RawQuery = query.Encode()
+	}
+	return scheme + "://" + r.Host + u.RequestURI()
+}
+
+// query returns the query of r with sensitive values redacted,
+// ok is false when none is.
+func (c captureRules) query(r *http.Request) (query url.Values, ok bool) {
+	query = r.URL.Query()
+	for name, values := range query {
+		if c.redactQuery[strings.ToLower(name)] {
+			for i := range values {
+				values[i] = redacted
+			}
+			ok = true
+		}
+	}
+	return query, ok
+}
+
+func (c captureRules) queryString(r *http.Request) []har.NameValue {
+	query, _ := c.query(r)
+
+	pairs := []har.NameValue{}
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, har.NameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"consulsv1/har"
+)
+
+func TestCaptureRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	writer, err := har.NewWriter(path, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := newCaptureRules("POST", "^/dump_post$", "Authorization", "token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := captureRequests(writer, rules, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/dump_post?x=1&Token=secret", strings.NewReader(`{"a":1}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	handler(httptest.NewRecorder(), req)
+
+	// filtered out by method
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dump_post", nil))
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := har.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(doc.Log.Entries) != 1 {
+		t.Fatalf("%d entries captured, want 1", len(doc.Log.Entries))
+	}
+
+	entry := doc.Log.Entries[0]
+	if entry.Request.PostData == nil || entry.Request.PostData.Text != `{"a":1}` {
+		t.Errorf("unexpected post data %+v", entry.Request.PostData)
+	}
+	if entry.Response.Status != http.StatusCreated || entry.Response.Content.Text != `{"a":1}` {
+		t.Errorf("unexpected response %+v", entry.Response)
+	}
+	for _, h := range entry.Request.Headers {
+		if h.Name == "Authorization" && h.Value != redacted {
+			t.Errorf("Authorization not redacted: %q", h.Value)
+		}
+	}
+	if strings.Contains(entry.Request.URL, "secret") {
+		t.Errorf("token not redacted in %s", entry.Request.URL)
+	}
+	for _, q := range entry.Request.QueryString {
+		if q.Name == "Token" && q.Value != redacted {
+			t.Errorf("token not redacted: %q", q.Value)
+		}
+	}
+}
+
+func TestCaptureBodies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	writer, err := har.NewWriter(path, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := newCaptureRules("", "", "", "", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := captureRequests(writer, rules, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+
+	bodies := []string{"abc", "abcdef", "ab\u00e9\u00e9", "\xff\x00\x01", "\xff\x00\x01\x02\x03"}
+	for _, body := range bodies {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := har.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text, encoding string
+		truncated      bool
+	}{
+		{"abc", "", false},
+		{"abcd", "", true},
+		{"ab\u00e9", "", true}, // a rune is not split
+		{"/wAB", har.Base64, false},
+		{"/wABAg==", har.Base64, true},
+	}
+	for i, test := range tests {
+		entry := doc.Log.Entries[i]
+		post, content := entry.Request.PostData, entry.Response.Content
+
+		if post.Text != test.text || post.Encoding != test.encoding || post.Truncated != test.truncated {
+			t.Errorf("%q: post data %+v", bodies[i], post)
+		}
+		if content.Text != test.text || content.Encoding != test.encoding || content.Truncated != test.truncated {
+			t.Errorf("%q: content %+v", bodies[i], content)
+		}
+		if entry.Request.BodySize != len(bodies[i]) || content.Size != len(bodies[i]) {
+			t.Errorf("%q: sizes %d and %d", bodies[i], entry.Request.BodySize, content.Size)
+		}
+	}
+}
+
+func TestCaptureLimitsReads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	writer, err := har.NewWriter(path, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := newCaptureRules("", "", "", "", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received string
+	handler := captureRequests(writer, rules, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Write(body)
+		w.Write(body)
+	})
+
+	body := strings.Repeat("x", 100)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.ContentLength = -1 // chunked
+	handler(w, req)
+
+	if received != body || w.Body.String() != body+body {
+		t.Errorf("handler read %d bytes and wrote %d, want the whole body", len(received), w.Body.Len())
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := har.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := doc.Log.Entries[0]
+	if post := entry.Request.PostData; post.Text != "xxxx" || !post.Truncated || entry.Request.BodySize != -1 {
+		t.Errorf("post data %+v, body size %d", post, entry.Request.BodySize)
+	}
+	if content := entry.Response.Content; content.Text != "xxxx" || !content.Truncated || content.Size != 200 {
+		t.Errorf("content %+v", content)
+	}
+}
@@ -0,0 +1,325 @@
+// replay re-sends the requests of a HAR capture to another upstream
+// and reports the responses that differ from the captured ones.
+//
+//	go run ./cmd/replay -har capture.har -upstream http://localhost:8081
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"consulsv1/har"
+)
+
+// redacted is the value capture puts in place of sensitive headers
+// and query parameters, those are not replayed.
+const redacted = "REDACTED"
+
+func main() {
+	harFile := flag.String("har", "capture.har", "HAR file to replay")
+	upstream := flag.String("upstream", "", "base URL the requests are sent to, e.g. http://localhost:8081")
+	path := flag.String("path", "", "only replay requests whose captured path matches this regular expression")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of each replayed request")
+	flag.Parse()
+
+	if *upstream == "" {
+		log.Fatal("-upstream is required")
+	}
+
+	target, err := url.Parse(*upstream)
+	if err != nil {
+		log.Fatalf("Invalid upstream: %v", err)
+	}
+
+	var filter *regexp.Regexp
+	if *path != "" {
+		filter, err = regexp.Compile(*path)
+		if err != nil {
+			log.Fatalf("Invalid path filter: %v", err)
+		}
+	}
+
+	doc, err := har.Read(*harFile)
+	if err != nil {
+		log.Fatalf("Failed to read capture: %v", err)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	replayed, differing, skipped := 0, 0, 0
+
+	for i, entry := range doc.Log.Entries {
+		if !matches(filter, entry.Request) {
+			continue
+		}
+
+		// a cut body would replay a different request
+		if post := entry.Request.PostData; post != nil && post.Truncated {
+			log.Printf("#%d: skipped: request body truncated at capture", i)
+			skipped++
+			continue
+		}
+
+		req, err := newRequest(entry.Request, target)
+		if err != nil {
+			log.Printf("#%d: skipped: %v", i, err)
+			skipped++
+			continue
+		}
+
+		replayed++
+		res, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("#%d %s %s\n\terror: %v\n", i, req.Method, req.URL, err)
+			differing++
+			continue
+		}
+
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			fmt.Printf("#%d %s %s\n\terror: failed to read response: %v\n", i, req.Method, req.URL, err)
+			differing++
+			continue
+		}
+
+		diffs := diffResponse(entry.Response, res, body)
+		if len(diffs) == 0 {
+			continue
+		}
+
+		differing++
+		fmt.Printf("#%d %s %s\n", i, req.Method, req.URL)
+		for _, d := range diffs {
+			fmt.Println("\t" + strings.ReplaceAll(d, "\n", "\n\t"))
+		}
+	}
+
+	fmt.Printf("%d requests replayed, %d responses differ, %d skipped\n", replayed, differing, skipped)
+	if differing > 0 {
+		os.Exit(1)
+	}
+}
+
+// matches reports whether the path of a captured request matches
+// filter, a nil filter matches every request. Requests whose URL
+// cannot be parsed match, so that they are reported as skipped.
+func matches(filter *regexp.Regexp, captured har.Request) bool {
+	if filter == nil {
+		return true
+	}
+
+	u, err := url.Parse(captured.URL)
+	if err != nil {
+		return true
+	}
+	return filter.MatchString(u.Path)
+}
+
+// newRequest rebuilds a captured request against target.
+func newRequest(captured har.Request, target *url.URL) (*http.Request, error) {
+	u, err := url.Parse(captured.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	u.Path = strings.TrimSuffix(target.Path, "/") + u.Path
+
+	query, dropped := u.Query(), false
+	for name, values := range query {
+		if slices.Contains(values, redacted) {
+			query[name] = slices.DeleteFunc(values, func(v string) bool { return v == redacted })
+			dropped = true
+		}
+	}
+	if dropped {
+		u.RawQuery = query.Encode()
+	}
+
+	var body io.Reader
+	if captured.PostData != nil {
+		raw, err := captured.PostData.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(captured.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range captured.Headers {
+		switch {
+		case h.Value == redacted:
+		case strings.EqualFold(h.Name, "Content-Length"), strings.EqualFold(h.Name, "Host"):
+		default:
+			req.Header.Add(h.Name, h.Value)
+		}
+	}
+
+	return req, nil
+}
+
+// diffResponse compares the status, content type and body of a
+// replayed response with the captured one. Of a truncated captured
+// body, only the captured bytes are compared.
+func diffResponse(captured har.Response, res *http.Response, body []byte) []string {
+	diffs := []string{}
+
+	if captured.Status != res.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status: %d -> %d", captured.Status, res.StatusCode))
+	}
+
+	if got := res.Header.Get("Content-Type"); captured.Content.MimeType != got {
+		diffs = append(diffs, fmt.Sprintf("content type: %q -> %q", captured.Content.MimeType, got))
+	}
+
+	content, err := captured.Content.Bytes()
+	if err != nil {
+		return append(diffs, fmt.Sprintf("body: captured body unreadable: %v", err))
+	}
+
+	switch {
+	case captured.Content.Truncated:
+		if !bytes.HasPrefix(body, content) {
+			diffs = append(diffs, fmt.Sprintf("body: does not start with the %d captured bytes", len(content)))
+		} else if len(body) != captured.Content.Size {
+			diffs = append(diffs, fmt.Sprintf("body size: %d -> %d", captured.Content.Size, len(body)))
+		}
+	case captured.Content.Encoding != "":
+		if !bytes.Equal(content, body) {
+			diffs = append(diffs, fmt.Sprintf("body: binary bodies differ, %d -> %d bytes", len(content), len(body)))
+		}
+	default:
+		want, got := normalize(string(content)), normalize(string(body))
+		if want != got {
+			diffs = append(diffs, "body:\n"+diffLines(want, got))
+		}
+	}
+
+	return diffs
+}
+
+// normalize indents JSON bodies so that formatting differences
+// are ignored and the diff is line oriented.
+func normalize(body string) string {
+	var out bytes.Buffer
+	if err := json.Indent(&out, []byte(body), "", "  "); err == nil {
+		return out.String()
+	}
+	return body
+}
+
+// diffContext is how many unchanged lines are shown around changes.
+const diffContext = 2
+
+// maxDiffCells bounds the LCS table of diffLines, bodies differing
+// on more lines are only reported as different.
+const maxDiffCells = 1 << 22
+
+// diffLines returns a minimal line diff of a and b, using the
+// longest common subsequence of their lines. Only the changed lines
+// are shown, with diffContext lines around them; "..." stands for
+// the unchanged lines in between.
+func diffLines(a, b string) string {
+	if a == b {
+		return ""
+	}
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// the LCS table only covers the lines between
+	// the common prefix and the common suffix
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+	mx, my := x[prefix:len(x)-suffix], y[prefix:len(y)-suffix]
+
+	if (len(mx)+1)*(len(my)+1) > maxDiffCells {
+		return fmt.Sprintf("bodies differ on too many lines to diff, %d -> %d lines", len(x), len(y))
+	}
+
+	// lcs[i][j] is the LCS length of mx[i:] and my[j:]
+	lcs := make([][]int, len(mx)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(my)+1)
+	}
+	for i := len(mx) - 1; i >= 0; i-- {
+		for j := len(my) - 1; j >= 0; j-- {
+			if mx[i] == my[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := []string{}
+	for _, line := range x[:prefix] {
+		lines = append(lines, "  "+line)
+	}
+	i, j := 0, 0
+	for i < len(mx) || j < len(my) {
+		switch {
+		case i < len(mx) && j < len(my) && mx[i] == my[j]:
+			lines = append(lines, "  "+mx[i])
+			i++
+			j++
+		case j < len(my) && (i == len(mx) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, "+ "+my[j])
+			j++
+		default:
+			lines = append(lines, "- "+mx[i])
+			i++
+		}
+	}
+	for _, line := range x[len(x)-suffix:] {
+		lines = append(lines, "  "+line)
+	}
+
+	// keep the changes and the lines around them
+	keep := make([]bool, len(lines))
+	for k, line := range lines {
+		if !strings.HasPrefix(line, "  ") {
+			for c := max(k-diffContext, 0); c <= min(k+diffContext, len(lines)-1); c++ {
+				keep[c] = true
+			}
+		}
+	}
+
+	var out strings.Builder
+	skipped := false
+	for k, line := range lines {
+		if !keep[k] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			out.WriteString("...\n")
+			skipped = false
+		}
+		out.WriteString(line + "\n")
+	}
+	if skipped {
+		out.WriteString("...\n")
+	}
+
+	return strings.TrimSuffix(out.String(), "\n")
+}
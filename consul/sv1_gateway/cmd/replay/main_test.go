@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"consulsv1/har"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name, a, b, want string
+	}{
+		{"equal", "a\nb", "a\nb", ""},
+		{"added", "a\nc", "a\nb\nc", "  a\n+ b\n  c"},
+		{"removed", "a\nb\nc", "a\nc", "  a\n- b\n  c"},
+		{"changed", "a\nb\nc", "a\nx\nc", "  a\n+ x\n- b\n  c"},
+		{"from empty", "", "a", "+ a\n- "},
+		{"all different", "a\nb", "c", "+ c\n- a\n- b"},
+		{"hunks", "1\n2\n3\n4\n5\n6\n7\n8\n9", "1\nx\n3\n4\n5\n6\n7\n8\ny", "  1\n+ x\n- 2\n  3\n  4\n...\n  7\n  8\n+ y\n- 9"},
+		{"context", "1\n2\n3\n4\n5\n6", "1\n2\n3\nx\n5\n6", "...\n  2\n  3\n+ x\n- 4\n  5\n  6"},
+	}
+
+	for _, test := range tests {
+		if got := diffLines(test.a, test.b); got != test.want {
+			t.Errorf("%s: diffLines(%q, %q) = %q, want %q", test.name, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestDiffLinesTooLong(t *testing.T) {
+	a := strings.Repeat("a\n", 3000) + "end"
+	b := strings.Repeat("b\n", 3000) + "end"
+	if got, want := diffLines(a, b), "bodies differ on too many lines to diff, 3001 -> 3001 lines"; got != want {
+		t.Errorf("diffLines = %q, want %q", got, want)
+	}
+}
+
+func TestDiffResponse(t *testing.T) {
+	text := func(body string) har.Content {
+		return har.Content{Size: len(body), MimeType: "application/json", Text: body}
+	}
+
+	tests := []struct {
+		name     string
+		captured har.Response
+		status   int
+		mimeType string
+		body     string
+		want     []string
+	}{
+		{
+			name:     "same",
+			captured: har.Response{Status: 200, Content: text(`{"a":1}`)},
+			status:   200, mimeType: "application/json", body: `{"a":1}`,
+		},
+		{
+			name:     "JSON formatting is ignored",
+			captured: har.Response{Status: 200, Content: text(`{"a":1,"b":2}`)},
+			status:   200, mimeType: "application/json", body: "{\n\"a\": 1, \"b\": 2}",
+		},
+		{
+			name:     "status and content type",
+			captured: har.Response{Status: 200, Content: text("")},
+			status:   404, mimeType: "text/plain",
+			want: []string{"status: 200 -> 404", `content type: "application/json" -> "text/plain"`},
+		},
+		{
+			name:     "body",
+			captured: har.Response{Status: 200, Content: text(`{"a":1}`)},
+			status:   200, mimeType: "application/json", body: `{"a":2}`,
+			want: []string{"body:\n  {\n+   \"a\": 2\n-   \"a\": 1\n  }"},
+		},
+		{
+			name:     "truncated prefix matches",
+			captured: har.Response{Status: 200, Content: har.Content{Size: 6, MimeType: "text/plain", Text: "abc", Truncated: true}},
+			status:   200, mimeType: "text/plain", body: "abcdef",
+		},
+		{
+			name:     "truncated size differs",
+			captured: har.Response{Status: 200, Content: har.Content{Size: 6, MimeType: "text/plain", Text: "abc", Truncated: true}},
+			status:   200, mimeType: "text/plain", body: "abcd",
+			want: []string{"body size: 6 -> 4"},
+		},
+		{
+			name:     "truncated prefix differs",
+			captured: har.Response{Status: 200, Content: har.Content{Size: 6, MimeType: "text/plain", Text: "abc", Truncated: true}},
+			status:   200, mimeType: "text/plain", body: "xbcdef",
+			want: []string{"body: does not start with the 3 captured bytes"},
+		},
+		{
+			name:     "binary",
+			captured: har.Response{Status: 200, Content: har.Content{Size: 2, MimeType: "image/png", Text: "//8=", Encoding: har.Base64}},
+			status:   200, mimeType: "image/png", body: "\xff\xfe",
+			want: []string{"body: binary bodies differ, 2 -> 2 bytes"},
+		},
+		{
+			name:     "unreadable capture",
+			captured: har.Response{Status: 200, Content: har.Content{MimeType: "text/plain", Text: "!", Encoding: "gzip"}},
+			status:   200, mimeType: "text/plain",
+			want: []string{`body: captured body unreadable: unknown body encoding "gzip"`},
+		},
+	}
+
+	for _, test := range tests {
+		res := &http.Response{StatusCode: test.status, Header: http.Header{}}
+		res.Header.Set("Content-Type", test.mimeType)
+
+		got := diffResponse(test.captured, res, []byte(test.body))
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: diffResponse = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	filter := regexp.MustCompile("^/dump_post$")
+
+	tests := []struct {
+		filter *regexp.Regexp
+		url    string
+		want   bool
+	}{
+		{nil, "http://gateway/anything", true},
+		{filter, "http://gateway/dump_post?x=1", true},
+		{filter, "http://gateway/other", false},
+		{filter, "http://gateway/%zz", true}, // reported as skipped
+	}
+
+	for _, test := range tests {
+		if got := matches(test.filter, har.Request{URL: test.url}); got != test.want {
+			t.Errorf("matches(%v, %q) = %v, want %v", test.filter, test.url, got, test.want)
+		}
+	}
+}
+
+func TestNewRequestDropsRedacted(t *testing.T) {
+	target, _ := url.Parse("http://localhost:8081")
+	captured := har.Request{
+		Method:  "POST",
+		URL:     "http://gateway/dump_post?token=REDACTED&x=1",
+		Headers: []har.NameValue{{Name: "Authorization", Value: redacted}, {Name: "X-Id", Value: "7"}},
+	}
+
+	req, err := newRequest(captured, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.URL.String(), "http://localhost:8081/dump_post?x=1"; got != want {
+		t.Errorf("URL %s, want %s", got, want)
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("X-Id") != "7" {
+		t.Errorf("headers %v", req.Header)
+	}
+}
@@ -0,0 +1,302 @@
+// Package har reads and writes HTTP Archive (HAR 1.2) files,
+// the format browsers' dev tools export traffic in.
+package har
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HAR is the root of a HAR document.
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is a request and the response it got.
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"` // milliseconds
+	Request         Request   `json:"request"`
+	Response        Response  `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         Timings   `json:"timings"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PostData is a request body. HAR has no encoding for post data,
+// binary bodies are base64 encoded and flagged by the custom
+// _encoding field, as Content does with encoding.
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+	// Truncated is set when Text holds only the start of the body,
+	// Request.BodySize is the size of the whole body.
+	Truncated bool `json:"_truncated,omitempty"`
+}
+
+// Bytes decodes the body.
+func (p PostData) Bytes() ([]byte, error) {
+	return decode(p.Text, p.Encoding)
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	// Truncated is set when Text holds only the first bytes of
+	// the Size bytes of the body.
+	Truncated bool `json:"_truncated,omitempty"`
+}
+
+// Bytes decodes the body.
+func (c Content) Bytes() ([]byte, error) {
+	return decode(c.Text, c.Encoding)
+}
+
+// Base64 is the encoding of bodies that are not valid UTF-8.
+const Base64 = "base64"
+
+func decode(text, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(text), nil
+	case Base64:
+		return base64.StdEncoding.DecodeString(text)
+	default:
+		return nil, fmt.Errorf("unknown body encoding %q", encoding)
+	}
+}
+
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Headers converts h to HAR name/value pairs, sorted by name.
+func Headers(h http.Header) []NameValue {
+	pairs := []NameValue{}
+	for name, values := range h {
+		for _, value := range values {
+			pairs = append(pairs, NameValue{Name: name, Value: value})
+		}
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].Name < pairs[j].Name
+	})
+	return pairs
+}
+
+// Read loads a HAR file.
+func Read(path string) (*HAR, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &HAR{}
+	if err := json.Unmarshal(raw, doc); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+
+	return doc, nil
+}
+
+// Writer keeps a HAR file up to date with the entries added to it.
+// A HAR file is a single JSON document that has to be rewritten
+// as a whole, so Add only queues the entry and the file is written
+// in the background, at most once per flush interval.
+type Writer struct {
+	path       string
+	maxEntries int
+	interval   time.Duration
+
+	mu    sync.Mutex
+	doc   HAR
+	dirty bool
+	err   error // of the last background write
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWriter creates a writer for path, keeping the entries already
+// there. Only the latest maxEntries are kept, 0 means no limit.
+// The file is written at most once per interval, Close writes
+// the entries still pending.
+func NewWriter(path string, maxEntries int, interval time.Duration) (*Writer, error) {
+	w := &Writer{
+		path:       path,
+		maxEntries: maxEntries,
+		interval:   interval,
+		doc: HAR{Log: Log{
+			Version: "1.2",
+			Creator: Creator{Name: "sv1_gateway", Version: "1.0"},
+			Entries: []Entry{},
+		}},
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	existing, err := Read(path)
+	switch {
+	case err == nil:
+		w.doc.Log.Entries = existing.Log.Entries
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Add queues entry to be written. It returns the error
+// of the last write that failed since the previous Add.
+func (w *Writer) Add(entry Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.doc.Log.Entries = append(w.doc.Log.Entries, entry)
+	if w.maxEntries > 0 && len(w.doc.Log.Entries) > w.maxEntries {
+		w.doc.Log.Entries = w.doc.Log.Entries[len(w.doc.Log.Entries)-w.maxEntries:]
+	}
+	w.dirty = true
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	err := w.err
+	w.err = nil
+	return err
+}
+
+// Close writes the pending entries and stops the writer.
+func (w *Writer) Close() error {
+	close(w.stop)
+	<-w.done
+	return w.flush()
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.wake:
+		}
+
+		if err := w.flush(); err != nil {
+			w.mu.Lock()
+			w.err = err
+			w.mu.Unlock()
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// flush writes the file if entries were added since the last write.
+func (w *Writer) flush() error {
+	w.mu.Lock()
+	if !w.dirty {
+		w.mu.Unlock()
+		return nil
+	}
+	// Entries are only appended or dropped from the front,
+	// the snapshot stays valid once the lock is released.
+	doc := w.doc
+	w.dirty = false
+	w.mu.Unlock()
+
+	if err := write(w.path, doc); err != nil {
+		w.mu.Lock()
+		w.dirty = true
+		w.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// write replaces the file atomically so readers never
+// see a half written document.
+func write(path string, doc HAR) error {
+	raw, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".har-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,108 @@
+package har
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func entry(url string) Entry {
+	return Entry{
+		StartedDateTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Request: Request{
+			Method:   "POST",
+			URL:      url,
+			PostData: &PostData{MimeType: "application/octet-stream", Text: "AAE=", Encoding: Base64},
+		},
+		Response: Response{Status: 201, Content: Content{Size: 10, MimeType: "text/plain", Text: "hello", Truncated: true}},
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+
+	w, err := NewWriter(path, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"http://a/1", "http://a/2", "http://a/3"} {
+		if err := w.Add(entry(url)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Log.Version != "1.2" || len(doc.Log.Entries) != 2 {
+		t.Fatalf("read version %q with %d entries, want 1.2 with the last 2", doc.Log.Version, len(doc.Log.Entries))
+	}
+
+	got := doc.Log.Entries[1]
+	if got.Request.URL != "http://a/3" || !got.StartedDateTime.Equal(entry("").StartedDateTime) {
+		t.Errorf("last entry %+v", got)
+	}
+	if body, err := got.Request.PostData.Bytes(); err != nil || string(body) != "\x00\x01" {
+		t.Errorf("post data %q, %v", body, err)
+	}
+	if c := got.Response.Content; !c.Truncated || c.Size != 10 || c.Text != "hello" {
+		t.Errorf("content %+v", c)
+	}
+
+	// a new writer keeps the entries of the file
+	w, err = NewWriter(path, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Add(entry("http://a/4"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := Read(path); err != nil || len(doc.Log.Entries) != 3 {
+		t.Fatalf("reopened file: %v, %+v", err, doc)
+	}
+
+	// the rewrites leave no temporary file behind
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("files left: %v", files)
+	}
+}
+
+func TestWriterFlushesInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+
+	w, err := NewWriter(path, 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Add(entry("http://a/1"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if doc, err := Read(path); err == nil && len(doc.Log.Entries) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the entry was not written before Close")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewWriterRejectsBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewWriter(path, 0, time.Hour); err == nil {
+		t.Error("NewWriter accepted a file that is not a HAR document")
+	}
+}
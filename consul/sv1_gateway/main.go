@@ -1,107 +1,112 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
-	"github.com/hashicorp/consul/api"
+	"consulsv1/har"
+
+	"consulkit/health"
+	"consulkit/kvconfig"
+	"consulkit/registration"
+	"consulkit/service"
 )
 
+// serviceConfig holds the limits of /dump_post.
+type serviceConfig struct {
+	// MaxBodyBytes caps the logged body of /dump_post, 0 means no limit.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+}
+
 func main() {
-	// Service configuration
-	serviceID := "example-service-1"
-	serviceName := "example-service"
-	servicePort := 8080
-	serviceAddress := "127.0.0.1"
-	consulAddress := "http://localhost:8500"
-
-	config := &api.Config{
-		Address: consulAddress, // Consul address
+	// Service configuration, overridable from env and flags
+	cfg := registration.Config{
+		ID:      "example-service-1",
+		Name:    "example-service",
+		Address: "127.0.0.1",
+		Port:    8080,
+		// heartbeats come from the health reporter
+		CheckSpecs: []string{"ttl:15s"},
+		Tags:       []string{"gateway"},
 	}
-
-	client, err := api.NewClient(config)
-	if err != nil {
-		log.Fatalf("Failed to create Consul client: %v", err)
+	if err := cfg.BindFlags(flag.CommandLine); err != nil {
+		log.Fatalf("Invalid service configuration: %v", err)
 	}
-
-	// Start a simple HTTP server
-	go startHTTPServer(servicePort)
+	var opts service.Options
+	opts.BindFlags(flag.CommandLine)
+	captureFile := flag.String("capture-file", "", "HAR file /dump_post requests are captured to, capture is off when empty")
+	captureMethods := flag.String("capture-methods", "POST,PUT", "comma separated methods to capture, all when empty")
+	capturePath := flag.String("capture-path", "", "regular expression the captured paths must match")
+	captureMax := flag.Int("capture-max-entries", 1000, "number of requests kept in the capture file, 0 means no limit")
+	captureMaxBody := flag.Int("capture-max-body", 64<<10, "bytes of each body buffered and kept in the capture file, 0 means no limit")
+	captureFlush := flag.Duration("capture-flush", time.Second, "how often the capture file is rewritten with the new requests")
+	redactHeaders := flag.String("redact-headers", "Authorization,Proxy-Authorization,Cookie,Set-Cookie,X-Api-Key", "comma separated headers whose values are redacted in captures")
+	redactQuery := flag.String("redact-query", "access_token,api_key,token,password", "comma separated query parameters whose values are redacted in captures")
+	gatewayAddress := flag.String("gateway-address", "localhost:7000", "host:port of the gateway, probed for the health report")
+	flag.Parse()
 
 	// Register the service with Consul
-	err = registerServiceWithConsul(
-		serviceID,
-		serviceName,
-		serviceAddress,
-		servicePort,
-		client,
-	)
+	reg, err := registration.Register(cfg)
 	if err != nil {
 		log.Fatalf("Failed to register service with Consul: %v", err)
 	}
 
-	fmt.Printf("Service %s is running on %s:%d and registered with Consul.\n", serviceName, serviceAddress, servicePort)
+	svc, err := service.Start[serviceConfig](context.Background(), reg, opts, health.TCPProbe("gateway", *gatewayAddress, false))
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	dump := dumpPost(svc.Settings)
+	var capture *har.Writer
+	if *captureFile != "" {
+		rules, err := newCaptureRules(*captureMethods, *capturePath, *redactHeaders, *redactQuery, *captureMaxBody)
+		if err != nil {
+			log.Fatalf("Invalid capture rules: %v", err)
+		}
 
-	// Wait for termination signal
-	<-sigs
+		capture, err = har.NewWriter(*captureFile, *captureMax, *captureFlush)
+		if err != nil {
+			log.Fatalf("Failed to open capture file: %v", err)
+		}
 
-	// Deregister the service upon shutdown
-	err = client.Agent().ServiceDeregister(serviceID)
-	if err != nil {
-		log.Fatalf("Failed to deregister service: %v", err)
+		dump = captureRequests(capture, rules, dump)
 	}
-	fmt.Println("Service deregistered from Consul")
 
-}
+	// Start a simple HTTP server
+	go startHTTPServer(cfg.Port, svc, dump)
 
-// registerServiceWithConsul registers the service with Consul
-func registerServiceWithConsul(
-	serviceID,
-	serviceName,
-	serviceAddress string,
-	servicePort int,
-	consulClient *api.Client,
-) error {
-	// Create a Consul client
-
-	// Define the service registration
-	registration := &api.AgentServiceRegistration{
-		ID:      serviceID,
-		Name:    serviceName,
-		Address: serviceAddress,
-		Port:    servicePort,
-		Check: &api.AgentServiceCheck{
-			HTTP:     fmt.Sprintf("http://%s:%d/health", serviceAddress, servicePort),
-			Interval: "10s",
-			Timeout:  "5s",
-		},
-		Tags: []string{"gateway"},
-	}
+	fmt.Printf("Service %s is running on %s:%d and registered with Consul.\n", cfg.Name, cfg.Address, cfg.Port)
 
-	// Register the service
-	err := consulClient.Agent().ServiceRegister(registration)
-	if err != nil {
-		return fmt.Errorf("failed to register service: %v", err)
-	}
+	// Wait for termination signal, then deregister
+	reg.DeregisterOnSignal()
 
-	return nil
+	if capture != nil {
+		if err := capture.Close(); err != nil {
+			log.Println("Error writing capture:", err)
+		}
+	}
 }
 
 // startHTTPServer starts a simple HTTP server with a health check endpoint
-func startHTTPServer(port int) {
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "OK")
-	})
+func startHTTPServer(port int, svc *service.Service[serviceConfig], dump http.HandlerFunc) {
+	svc.Handle(http.DefaultServeMux)
+	http.HandleFunc("/dump_post", dump)
+
+	log.Printf("Starting HTTP server on :%d...\n", port)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	if err != nil {
+		log.Fatalf("Failed to start HTTP server: %v", err)
+	}
+}
 
-	http.HandleFunc("/dump_post", func(w http.ResponseWriter, r *http.Request) {
+// dumpPost logs the headers and body of the requests it receives
+func dumpPost(settings *kvconfig.Watcher[serviceConfig]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Request Headers:")
 		for name, values := range r.Header {
 			for _, value := range values {
@@ -114,7 +119,12 @@ func startHTTPServer(port int) {
 
 		// Dump the request body if it's a POST or PUT request
 		if r.Method == "POST" || r.Method == "PUT" {
-			body, err := io.ReadAll(r.Body)
+			var reader io.Reader = r.Body
+			if limit := settings.Get().MaxBodyBytes; limit > 0 {
+				reader = io.LimitReader(r.Body, limit)
+			}
+
+			body, err := io.ReadAll(reader)
 			if err != nil {
 				log.Println("Error reading request body:", err)
 				http.Error(w, "Unable to read request body", http.StatusInternalServerError)
@@ -126,11 +136,5 @@ func startHTTPServer(port int) {
 			log.Println("\t\t", string(body))
 		}
 
-	})
-
-	log.Printf("Starting HTTP server on :%d...\n", port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-	if err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
 	}
 }
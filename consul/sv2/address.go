@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// advertiseAddress picks the address the service registers with Consul.
+// HOST wins when set. Otherwise the interface addresses are matched
+// against the preferred CIDRs, in order, and the first non loopback
+// IPv4 address is used when none match. 127.0.0.1 is the last resort.
+func advertiseAddress(preferred []string) (string, error) {
+	if host := os.Getenv("HOST"); host != "" {
+		return host, nil
+	}
+
+	networks, err := parseCIDRs(preferred)
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list interface addresses: %v", err)
+	}
+
+	return pickAddress(addrs, networks), nil
+}
+
+// pickAddress returns the first address in the first matching network,
+// or the first usable IPv4 address when no network matches.
+func pickAddress(addrs []net.Addr, networks []*net.IPNet) string {
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+
+	for _, network := range networks {
+		for _, ip := range ips {
+			if network.Contains(ip) {
+				return ip.String()
+			}
+		}
+	}
+
+	for _, ip := range ips {
+		if ip.To4() != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+			return ip.String()
+		}
+	}
+
+	return "127.0.0.1"
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preferred CIDR %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// listen binds port, 0 picks a free one, and returns
+// the listener with the port actually bound.
+func listen(port int) (net.Listener, int, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ln, ln.Addr().(*net.TCPAddr).Port, nil
+}
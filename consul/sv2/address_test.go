@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPickAddress(t *testing.T) {
+	addrs := []net.Addr{}
+	for _, cidr := range []string{"127.0.0.1/8", "fe80::1/64", "172.17.0.2/16", "10.1.2.3/8"} {
+		ip, network, _ := net.ParseCIDR(cidr)
+		network.IP = ip
+		addrs = append(addrs, network)
+	}
+
+	tests := []struct {
+		preferred []string
+		want      string
+	}{
+		{nil, "172.17.0.2"},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3"},
+		{[]string{"192.168.0.0/16", "172.16.0.0/12"}, "172.17.0.2"},
+		{[]string{"192.168.0.0/16"}, "172.17.0.2"},
+	}
+
+	for _, tt := range tests {
+		networks, err := parseCIDRs(tt.preferred)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := pickAddress(addrs, networks); got != tt.want {
+			t.Errorf("pickAddress(%v) = %s, want %s", tt.preferred, got, tt.want)
+		}
+	}
+
+	if got := pickAddress(addrs[:2], nil); got != "127.0.0.1" {
+		t.Errorf("got %s without usable address", got)
+	}
+}
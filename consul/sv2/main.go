@@ -1,96 +1,141 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/hashicorp/consul/api"
+	"consulkit/health"
+	"consulkit/registration"
+	"consulkit/service"
 )
 
+// serviceConfig holds the greeting /hello answers with.
+type serviceConfig struct {
+	Greeting string `json:"greeting"`
+}
+
 func main() {
-	// Service configuration
-	serviceID := "example-service-2"
-	serviceName := "example-service-2"
-	servicePort := 8090
-	serviceAddress := getLocalIP()
-	consulAddress := "http://localhost:8500"
+	// Service configuration, overridable from env and flags
+	cfg := registration.Config{
+		ID:   "example-service-2",
+		Name: "example-service-2",
+		Port: 8090,
+		// heartbeats come from the health reporter
+		CheckSpecs: []string{"ttl:15s"},
+	}
+	if err := cfg.BindFlags(flag.CommandLine); err != nil {
+		log.Fatalf("Invalid service configuration: %v", err)
+	}
+	var opts service.Options
+	opts.BindFlags(flag.CommandLine)
+	drainDelay := flag.Duration("drain-delay", 10*time.Second, "how long to stay up while critical so the gateway stops routing here")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "how long in-flight requests may take to finish")
+	preferCIDRs := flag.String("prefer-cidr", os.Getenv("PREFER_CIDR"), "comma separated networks to pick the advertised address from, in order of preference")
+	flag.Parse()
 
-	// Start a simple HTTP server
-	go startHTTPServer(servicePort)
+	// An explicit -service-address wins over detection
+	if cfg.Address == "" {
+		address, err := advertiseAddress(strings.Split(*preferCIDRs, ","))
+		if err != nil {
+			log.Fatalf("Failed to detect service address: %v", err)
+		}
+		cfg.Address = address
+	}
 
-	// Register the service with Consul
-	err := registerServiceWithConsul(serviceID, serviceName, serviceAddress, consulAddress, servicePort)
+	// Bind before registering so the port registered is the one
+	// bound, -service-port 0 lets the system pick a free port.
+	listener, port, err := listen(cfg.Port)
 	if err != nil {
-		log.Fatalf("Failed to register service with Consul: %v", err)
+		log.Fatalf("Failed to listen on port %d: %v", cfg.Port, err)
 	}
+	cfg.Port = port
 
-	fmt.Printf("Service %s is running on %s:%d and registered with Consul.\n", serviceName, serviceAddress, servicePort)
-
-	// Prevent the program from exiting
-	select {}
-}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-// registerServiceWithConsul registers the service with Consul
-func registerServiceWithConsul(
-	serviceID,
-	serviceName,
-	serviceAddress,
-	consulAddress string,
-	servicePort int,
-) error {
-	// Create a Consul client
-	consulConfig := api.DefaultConfig()
-	consulConfig.Address = consulAddress
-
-	consulClient, err := api.NewClient(consulConfig)
+	// Register the service with Consul
+	reg, err := registration.Register(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to create Consul client: %v", err)
-	}
-
-	// Define the service registration
-	registration := &api.AgentServiceRegistration{
-		ID:      serviceID,
-		Name:    serviceName,
-		Address: serviceAddress,
-		Port:    servicePort,
-		Check: &api.AgentServiceCheck{
-			HTTP:     fmt.Sprintf("http://%s:%d/health", serviceAddress, servicePort),
-			Interval: "10s",
-			Timeout:  "5s",
-		},
+		log.Fatalf("Failed to register service with Consul: %v", err)
 	}
 
-	// Register the service
-	err = consulClient.Agent().ServiceRegister(registration)
+	svc, err := service.Start[serviceConfig](ctx, reg, opts)
 	if err != nil {
-		return fmt.Errorf("failed to register service: %v", err)
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	return nil
+	// Start a simple HTTP server
+	server := newHTTPServer(svc)
+	go func() {
+		log.Printf("Starting HTTP server on :%d...\n", cfg.Port)
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start HTTP server: %v", err)
+		}
+	}()
+
+	fmt.Printf("Service %s is running on %s:%d and registered with Consul.\n", cfg.Name, cfg.Address, cfg.Port)
+
+	// Wait for termination signal
+	<-ctx.Done()
+	stop()
+
+	shutdown(reg, svc.Reporter, server, *drainDelay, *shutdownTimeout)
 }
 
-// startHTTPServer starts a simple HTTP server with a health check endpoint
-func startHTTPServer(port int) {
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "OK")
-	})
+// shutdown takes the service out of rotation before stopping it:
+// it reports critical, gives the gateway time to stop routing
+// here, drains in-flight requests and finally deregisters.
+func shutdown(
+	reg *registration.Registration,
+	reporter *health.Reporter,
+	server *http.Server,
+	drainDelay,
+	shutdownTimeout time.Duration,
+) {
+	log.Println("Marking service critical")
+	reporter.MarkCritical(context.Background(), "shutting down")
 
-	log.Printf("Starting HTTP server on :%d...\n", port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-	if err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
+	log.Printf("Waiting %s for the gateway to drain", drainDelay)
+	time.Sleep(drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain HTTP server: %v", err)
+		server.Close()
+	}
+
+	// Deregister the service upon shutdown
+	if err := reg.Deregister(); err != nil {
+		log.Println(err)
+		return
 	}
+	fmt.Println("Service deregistered from Consul")
 }
 
-// getLocalIP gets the local IP address of the machine
-func getLocalIP() string {
-	// Fallback to localhost if environment variables are not set
-	host := os.Getenv("HOST")
-	if host == "" {
-		host = "127.0.0.1"
+// newHTTPServer creates a simple HTTP server with a health check endpoint
+func newHTTPServer(svc *service.Service[serviceConfig]) *http.Server {
+	mux := http.NewServeMux()
+	svc.Handle(mux)
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		greeting := svc.Settings.Get().Greeting
+		if greeting == "" {
+			greeting = "Hello"
+		}
+		fmt.Fprintln(w, greeting)
+	})
+
+	return &http.Server{
+		Handler: mux,
 	}
-	return host
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Batch operations.
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// BatchOp is one write of a batch. Updates and deletes name the
+// record by ID, creates and updates carry the new record. Version
+// makes updates and deletes conditional, see Versioned; zero
+// applies them whatever the version of the record.
+type BatchOp[T any] struct {
+	Op      string `json:"op"`
+	ID      string `json:"id,omitempty"`
+	Record  *T     `json:"record,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// check reports an operation missing its ID or record.
+func (op BatchOp[T]) check() error {
+	switch op.Op {
+	case BatchCreate, BatchUpdate, BatchDelete:
+	default:
+		return fmt.Errorf("unknown operation %q, use create, update or delete", op.Op)
+	}
+
+	if op.Op != BatchCreate && op.ID == "" {
+		return fmt.Errorf("%s needs an id", op.Op)
+	}
+	if op.Op != BatchDelete && op.Record == nil {
+		return fmt.Errorf("%s needs a record", op.Op)
+	}
+	return nil
+}
+
+// BatchError is returned by a Batcher when an operation
+// failed, none of the operations were applied.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Batcher DAOs apply a list of writes all or nothing. Errors
+// from the operations are wrapped in a BatchError. Batchers that
+// change the records, see Rewriter, leave the stored ones in the
+// records of ops.
+type Batcher[T any] interface {
+	Batch(ctx context.Context, ops []BatchOp[T]) error
+}
+
+// applyBatchOp runs op on d, Batchers use it on their copy of the records.
+func applyBatchOp[T any](ctx context.Context, d DAO[T], op BatchOp[T]) error {
+	if err := op.check(); err != nil {
+		return &BadRequestError{Err: err}
+	}
+
+	if op.Op != BatchCreate && op.Version != AnyVersion {
+		v, ok := d.(Versioned[T])
+		if !ok {
+			return fmt.Errorf("conditional %s: %w", op.Op, errors.ErrUnsupported)
+		}
+		if op.Op == BatchUpdate {
+			_, err := v.UpdateVersion(ctx, op.ID, op.Version, *op.Record)
+			return err
+		}
+		return v.DeleteVersion(ctx, op.ID, op.Version)
+	}
+
+	switch op.Op {
+	case BatchCreate:
+		return d.Add(ctx, *op.Record)
+	case BatchUpdate:
+		return d.Update(ctx, op.ID, *op.Record)
+	}
+	return d.Delete(ctx, op.ID)
+}
+
+// BatchRequest is the body of a batch request,
+// it holds at most 10000 operations.
+type BatchRequest[T any] struct {
+	Operations []BatchOp[T] `json:"operations" binding:"required,min=1,max=10000"`
+}
+
+// BatchResult is the outcome of one operation, with the status the
+// operation would have had on its own route. Operations that were
+// not applied because another one failed have status 424.
+type BatchResult[T any] struct {
+	Status  int      `json:"status"`
+	Op      string   `json:"op"`
+	ID      string   `json:"id,omitempty"`
+	Record  *T       `json:"record,omitempty"`
+	Problem *Problem `json:"problem,omitempty"`
+}
+
+// BatchResponse lists the results in the order of the operations.
+type BatchResponse[T any] struct {
+	Results []BatchResult[T] `json:"results"`
+}
+
+var batchStatus = map[string]int{
+	BatchCreate: http.StatusCreated,
+	BatchUpdate: http.StatusOK,
+	BatchDelete: http.StatusNoContent,
+}
+
+// BatchRecords applies the operations of the body all or nothing,
+// d must be a Batcher. The response has a result per operation;
+// when one fails, its status is the status of the response.
+func BatchRecords[T any](d DAO[T]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req BatchRequest[T]
+		if err := bindBody(ctx, &req); err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		results := make([]BatchResult[T], len(req.Operations))
+		for i, op := range req.Operations {
+			results[i] = BatchResult[T]{Status: batchStatus[op.Op], Op: op.Op, ID: op.ID, Record: op.Record}
+		}
+
+		// Report every invalid operation at once.
+		status := 0
+		for i, op := range req.Operations {
+			var p Problem
+			if err := op.check(); err != nil {
+				p = Problem{
+					Title:  http.StatusText(http.StatusUnprocessableEntity),
+					Status: http.StatusUnprocessableEntity,
+					Detail: err.Error(),
+				}
+			} else if op.Record != nil {
+				if err := binding.Validator.ValidateStruct(op.Record); err != nil {
+					p = problemFor(err)
+				}
+			}
+			if p.Status == 0 {
+				continue
+			}
+
+			results[i].Status, results[i].Problem = p.Status, &p
+			if status == 0 {
+				status = p.Status
+			}
+		}
+		if status != 0 {
+			respondBatch(ctx, status, results)
+			return
+		}
+
+		b, ok := d.(Batcher[T])
+		if !ok {
+			respondError(ctx, fmt.Errorf("batches: %w", errors.ErrUnsupported))
+			return
+		}
+
+		err := b.Batch(ctx.Request.Context(), req.Operations)
+		var failed *BatchError
+		if errors.As(err, &failed) && failed.Index >= 0 && failed.Index < len(results) {
+			p := problemFor(failed.Err)
+			results[failed.Index].Status, results[failed.Index].Problem = p.Status, &p
+			respondBatch(ctx, p.Status, results)
+			return
+		}
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, BatchResponse[T]{Results: results})
+	}
+}
+
+// respondBatch answers a failed batch, the operations
+// without a problem are marked as not applied.
+func respondBatch[T any](ctx *gin.Context, status int, results []BatchResult[T]) {
+	for i := range results {
+		if results[i].Problem == nil {
+			results[i].Status = http.StatusFailedDependency
+			results[i].Problem = &Problem{
+				Title:  http.StatusText(http.StatusFailedDependency),
+				Status: http.StatusFailedDependency,
+				Detail: "not applied, another operation of the batch failed",
+			}
+		}
+	}
+
+	ctx.JSON(status, BatchResponse[T]{Results: results})
+}
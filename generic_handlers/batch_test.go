@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestBatchRecords(t *testing.T) {
+	users := newTestUsers()
+	r := newTestRouter(users)
+
+	// The delete of Nobody fails, the create and update are rolled back.
+	w := do(r, "POST", "/users/batch", `{"operations":[
+		{"op":"create","record":{"username":"Bob"}},
+		{"op":"update","id":"Eve","record":{"username":"Eve","active":false}},
+		{"op":"delete","id":"Nobody"}
+	]}`)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("failed batch: %d %s", w.Code, w.Body)
+	}
+
+	res := BatchResponse[testUser]{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	statuses := []int{}
+	for _, result := range res.Results {
+		statuses = append(statuses, result.Status)
+	}
+	if want := []int{424, 424, 404}; !slices.Equal(statuses, want) {
+		t.Errorf("statuses %v, want %v", statuses, want)
+	}
+
+	all, _ := users.Dump(context.Background())
+	if len(all) != 2 || !all[1].Active {
+		t.Errorf("not rolled back: %v", all)
+	}
+
+	w = do(r, "POST", "/users/batch", `{"operations":[
+		{"op":"create","record":{"username":"Bob"}},
+		{"op":"update","id":"Bob","record":{"username":"Bob","active":true}},
+		{"op":"delete","id":"Adam"}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+
+	all, _ = users.Dump(context.Background())
+	if len(all) != 2 || all[0].Username != "Eve" || !all[1].Active {
+		t.Errorf("records %v", all)
+	}
+
+	if w := do(r, "POST", "/users/purge", `{}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown route: %d", w.Code)
+	}
+	if w := do(r, "POST", "/users/batch", `{"operations":[{"op":"upsert"}]}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown operation: %d", w.Code)
+	}
+}
+
+func TestFileDbBatch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db := openTestFileDb(t, dir)
+	db.Add(ctx, testUser{Username: "Adam"})
+
+	err := db.Batch(ctx, []BatchOp[testUser]{
+		{Op: BatchCreate, Record: &testUser{Username: "Eve"}},
+		{Op: BatchCreate, Record: &testUser{Username: "Adam"}},
+	})
+	if failed, ok := err.(*BatchError); !ok || failed.Index != 1 {
+		t.Fatalf("conflicting batch: %v", err)
+	}
+
+	err = db.Batch(ctx, []BatchOp[testUser]{
+		{Op: BatchCreate, Record: &testUser{Username: "Eve"}},
+		{Op: BatchUpdate, ID: "Adam", Record: &testUser{Username: "Adam", Active: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openTestFileDb(t, dir)
+	defer db.Close()
+
+	all, _ := db.Dump(ctx)
+	if len(all) != 2 || !all[0].Active || all[1].Username != "Eve" {
+		t.Errorf("after reopening: %v", all)
+	}
+	if _, version, _ := db.GetVersion(ctx, "Adam"); version != 3 {
+		t.Errorf("version %d, want 3", version)
+	}
+}
+
+func TestBatchRecordsFileDb(t *testing.T) {
+	ctx := context.Background()
+	db := openTestFileDb(t, t.TempDir())
+	defer db.Close()
+	db.Add(ctx, testUser{Username: "Adam"})
+	r := newTestRouter(db)
+
+	w := do(r, "POST", "/users/batch", `{"operations":[
+		{"op":"create","record":{"username":"Eve"}},
+		{"op":"update","id":"Adam","version":2,"record":{"username":"Adam","active":true}}
+	]}`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale version: %d %s", w.Code, w.Body)
+	}
+	if all, _ := db.Dump(ctx); len(all) != 1 {
+		t.Errorf("not rolled back: %v", all)
+	}
+
+	w = do(r, "POST", "/users/batch", `{"operations":[
+		{"op":"create","record":{"username":"Eve"}},
+		{"op":"update","id":"Adam","version":1,"record":{"username":"Adam","active":true}},
+		{"op":"delete","id":"Eve","version":2}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+
+	all, _ := db.Dump(ctx)
+	if len(all) != 1 || !all[0].Active {
+		t.Errorf("records %v", all)
+	}
+	if _, version, _ := db.GetVersion(ctx, "Adam"); version != 3 {
+		t.Errorf("version %d, want 3", version)
+	}
+}
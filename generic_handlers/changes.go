@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Change types.
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// Change is a write to a DAO, as sent on the change feed.
+// ID is the ID the record had before the change.
+type Change[T any] struct {
+	Seq    uint64    `json:"seq"`
+	Type   string    `json:"type"`
+	ID     string    `json:"id,omitempty"`
+	Record *T        `json:"record,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// ChangeLog keeps the last changes of a DAO and hands
+// them out to subscribers, see Observe.
+type ChangeLog[T any] struct {
+	size int
+	key  func(T) string
+	// epoch tells the logs of successive runs apart,
+	// sequence numbers start over with each of them.
+	epoch string
+
+	mu     sync.Mutex
+	seq    uint64
+	events []Change[T] // oldest first
+	subs   map[chan Change[T]]struct{}
+	closed bool
+}
+
+// NewChangeLog keeps the last size changes, key gives the ID
+// of created records, Identifiable records do without.
+func NewChangeLog[T any](size int, key func(T) string) *ChangeLog[T] {
+	return &ChangeLog[T]{
+		size:  size,
+		key:   key,
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:  map[chan Change[T]]struct{}{},
+	}
+}
+
+// eventID is the SSE ID of the change seq, <epoch>-<seq>.
+func (l *ChangeLog[T]) eventID(seq uint64) string {
+	return l.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseEventID returns the sequence number of an ID made by eventID,
+// current is false when the ID comes from another log, like the one
+// before a restart.
+func (l *ChangeLog[T]) parseEventID(id string) (seq uint64, current bool, err error) {
+	epoch, n, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, false, fmt.Errorf("invalid event ID %q", id)
+	}
+	seq, err = strconv.ParseUint(n, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid event ID %q", id)
+	}
+	return seq, epoch == l.epoch, nil
+}
+
+func (l *ChangeLog[T]) keyOf(record T) string {
+	if l.key != nil {
+		return l.key(record)
+	}
+	if r, ok := any(record).(Identifiable); ok {
+		return r.ID()
+	}
+	return ""
+}
+
+// publish numbers c and sends it to the subscribers. Subscribers
+// too slow to keep up are dropped, they resume from the log.
+func (l *ChangeLog[T]) publish(c Change[T]) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	c.Seq = l.seq
+	c.Time = time.Now().UTC()
+
+	l.events = append(l.events, c)
+	if over := len(l.events) - l.size; over > 0 {
+		l.events = append(l.events[:0], l.events[over:]...)
+	}
+
+	for ch := range l.subs {
+		select {
+		case ch <- c:
+		default:
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the changes after seq, none when seq is 0, and
+// a channel receiving the next ones until cancel is called. complete
+// is false when changes after seq already left the log, the
+// subscriber missed some and must reload the records.
+func (l *ChangeLog[T]) Subscribe(seq uint64) (backlog []Change[T], next <-chan Change[T], cancel func(), complete bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	oldest := l.seq + 1
+	if len(l.events) > 0 {
+		oldest = l.events[0].Seq
+	}
+
+	// seq past the last change was never handed
+	// out, see eventID for the logs of other runs.
+	complete = seq == 0 || (seq+1 >= oldest && seq <= l.seq)
+
+	if seq > 0 && complete {
+		for _, c := range l.events {
+			if c.Seq > seq {
+				backlog = append(backlog, c)
+			}
+		}
+	}
+
+	ch := make(chan Change[T], 64)
+	if l.closed {
+		close(ch)
+		return backlog, ch, func() {}, complete
+	}
+	l.subs[ch] = struct{}{}
+
+	cancel = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if _, ok := l.subs[ch]; ok {
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+
+	return backlog, ch, cancel, complete
+}
+
+// Close ends the subscriptions, as if the subscribers were too
+// slow, and those made afterwards. Changes are still logged.
+func (l *ChangeLog[T]) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	for ch := range l.subs {
+		delete(l.subs, ch)
+		close(ch)
+	}
+}
+
+// Observe wraps d so that its writes are published to changes.
+// The wrapper is Versioned when d is, and applies batches when
+// d is a Batcher. Its writes are serialized, so that changes are
+// published in the order d applied them.
+func Observe[T any](d DAO[T], changes *ChangeLog[T]) DAO[T] {
+	o := &observed[T]{DAO: d, changes: changes}
+	if v, ok := d.(Versioned[T]); ok {
+		return &observedVersioned[T]{observed: o, versioned: v}
+	}
+	return o
+}
+
+type observed[T any] struct {
+	DAO[T]
+	changes *ChangeLog[T]
+
+	mu sync.Mutex // held across a write and its publish
+}
+
+func (o *observed[T]) KeyOf(record T) (string, error) {
+	return recordKey(o.DAO, record)
+}
+
+func (o *observed[T]) Add(ctx context.Context, record T) error {
+	return o.AddRecord(ctx, &record)
+}
+
+// AddRecord publishes the record d stored, see Rewriter.
+func (o *observed[T]) AddRecord(ctx context.Context, record *T) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := addRecord(ctx, o.DAO, record); err != nil {
+		return err
+	}
+
+	stored := *record
+	o.changes.publish(Change[T]{Type: ChangeCreated, ID: o.changes.keyOf(stored), Record: &stored})
+	return nil
+}
+
+func (o *observed[T]) Update(ctx context.Context, id string, record T) error {
+	_, err := o.UpdateRecord(ctx, id, AnyVersion, &record)
+	return err
+}
+
+// UpdateRecord publishes the record d stored, see Rewriter.
+func (o *observed[T]) UpdateRecord(ctx context.Context, id string, version uint64, record *T) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	next, err := updateRecord(ctx, o.DAO, id, version, record)
+	if err != nil {
+		return next, err
+	}
+
+	stored := *record
+	o.changes.publish(Change[T]{Type: ChangeUpdated, ID: id, Record: &stored})
+	return next, nil
+}
+
+func (o *observed[T]) Delete(ctx context.Context, id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.DAO.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	o.changes.publish(Change[T]{Type: ChangeDeleted, ID: id})
+	return nil
+}
+
+// Batch publishes a change per operation once the batch is applied.
+func (o *observed[T]) Batch(ctx context.Context, ops []BatchOp[T]) error {
+	b, ok := o.DAO.(Batcher[T])
+	if !ok {
+		return fmt.Errorf("batches: %w", errors.ErrUnsupported)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := b.Batch(ctx, ops); err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		switch op.Op {
+		case BatchCreate:
+			o.changes.publish(Change[T]{Type: ChangeCreated, ID: o.changes.keyOf(*op.Record), Record: op.Record})
+		case BatchUpdate:
+			o.changes.publish(Change[T]{Type: ChangeUpdated, ID: op.ID, Record: op.Record})
+		case BatchDelete:
+			o.changes.publish(Change[T]{Type: ChangeDeleted, ID: op.ID})
+		}
+	}
+	return nil
+}
+
+type observedVersioned[T any] struct {
+	*observed[T]
+	versioned Versioned[T]
+}
+
+func (o *observedVersioned[T]) GetVersion(ctx context.Context, id string) (T, uint64, error) {
+	return o.versioned.GetVersion(ctx, id)
+}
+
+func (o *observedVersioned[T]) UpdateVersion(ctx context.Context, id string, version uint64, record T) (uint64, error) {
+	return o.UpdateRecord(ctx, id, version, &record)
+}
+
+func (o *observedVersioned[T]) DeleteVersion(ctx context.Context, id string, version uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.versioned.DeleteVersion(ctx, id, version); err != nil {
+		return err
+	}
+
+	o.changes.publish(Change[T]{Type: ChangeDeleted, ID: id})
+	return nil
+}
+
+// heartbeatEvery keeps idle feeds from being cut by proxies.
+const heartbeatEvery = 15 * time.Second
+
+// RegisterChanges serves changes as Server-Sent Events at path.
+// Every event carries the epoch of the log and the sequence number
+// of its change as ID, so browsers reconnecting with Last-Event-ID,
+// or clients passing ?last_event_id=, get the changes they missed.
+// When those already left the log, or the ID comes from before a
+// restart, a reset event tells the client to reload.
+//
+// The feed stays open, do not register it behind Timeout.
+func RegisterChanges[T any](group *gin.RouterGroup, path string, changes *ChangeLog[T]) {
+	group.GET(path, StreamChanges(changes))
+
+	DefaultSpec.Add(Operation{
+		Method:  http.MethodGet,
+		Path:    strings.TrimSuffix(group.BasePath(), "/") + path,
+		Summary: "Stream the changes to " + typeName(reflect.TypeFor[T]()) + " records",
+		Tag:     strings.Trim(strings.TrimSuffix(path, "/changes"), "/"),
+		Params: []Param{
+			{Name: "Last-Event-ID", In: "header", Type: reflect.TypeFor[string](), Description: "Resume after this event"},
+			{Name: "last_event_id", In: "query", Type: reflect.TypeFor[string](), Description: "Same as Last-Event-ID"},
+		},
+		Responses: []Response{{
+			Status:      http.StatusOK,
+			Description: "created, updated, deleted and reset events",
+			Type:        reflect.TypeFor[Change[T]](),
+			MediaTypes:  []string{"text/event-stream"},
+		}},
+	})
+}
+
+func StreamChanges[T any](changes *ChangeLog[T]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		lastID := ctx.GetHeader("Last-Event-ID")
+		if lastID == "" {
+			lastID = ctx.Query("last_event_id")
+		}
+
+		seq, current := uint64(0), true
+		if lastID != "" {
+			var err error
+			if seq, current, err = changes.parseEventID(lastID); err != nil {
+				respondError(ctx, &BadRequestError{Err: err})
+				return
+			}
+			if !current {
+				// the numbers of another run tell nothing
+				seq = 0
+			}
+		}
+
+		backlog, next, cancel, complete := changes.Subscribe(seq)
+		defer cancel()
+		complete = complete && current
+
+		ctx.Header("Content-Type", "text/event-stream")
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("X-Accel-Buffering", "no")
+		ctx.Status(http.StatusOK)
+
+		if !complete {
+			ctx.Render(-1, sse.Event{Event: "reset", Data: "changes were missed, reload the records"})
+		}
+		for _, c := range backlog {
+			ctx.Render(-1, sse.Event{Id: changes.eventID(c.Seq), Event: c.Type, Data: c})
+		}
+		ctx.Writer.Flush()
+
+		heartbeat := time.NewTicker(heartbeatEvery)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-ctx.Request.Context().Done():
+				return
+			case <-heartbeat.C:
+				ctx.Writer.WriteString(": ping\n\n")
+			case c, ok := <-next:
+				if !ok {
+					// Dropped for being too slow, the client
+					// reconnects with its Last-Event-ID.
+					return
+				}
+				ctx.Render(-1, sse.Event{Id: changes.eventID(c.Seq), Event: c.Type, Data: c})
+			}
+			ctx.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestChangeLogResume(t *testing.T) {
+	changes := NewChangeLog(3, func(u testUser) string { return u.Username })
+	users := Observe[testUser](newTestUsers(), changes)
+
+	ctx := context.Background()
+	users.Add(ctx, testUser{Username: "Bob"})
+	users.Update(ctx, "Bob", testUser{Username: "Bob", Active: true})
+	users.Delete(ctx, "Adam")
+	users.Delete(ctx, "Eve")
+	users.Add(ctx, testUser{Username: "Dan"})
+
+	if _, ok := users.(Versioned[testUser]); !ok {
+		t.Error("observed SliceDb is not Versioned")
+	}
+
+	cases := []struct {
+		seq      uint64
+		types    string
+		complete bool
+	}{
+		{0, "", true},
+		{3, "deleted created", true},
+		{2, "deleted deleted created", true},
+		{5, "", true},
+		{1, "", false},  // the second change left the log
+		{10, "", false}, // never handed out
+	}
+
+	for _, c := range cases {
+		backlog, _, cancel, complete := changes.Subscribe(c.seq)
+		cancel()
+
+		types := []string{}
+		for _, change := range backlog {
+			types = append(types, change.Type)
+		}
+		if got := strings.Join(types, " "); got != c.types || complete != c.complete {
+			t.Errorf("after %d: %q complete %v, want %q complete %v", c.seq, got, complete, c.types, c.complete)
+		}
+	}
+}
+
+func TestObservedPublishesInWriteOrder(t *testing.T) {
+	changes := NewChangeLog(1000, func(u testUser) string { return u.Username })
+	store := newTestUsers()
+	users := Observe[testUser](store, changes)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			users.Update(ctx, "Eve", testUser{Username: "Eve", Active: i%2 == 0})
+		}()
+	}
+	wg.Wait()
+
+	backlog, _, cancel, _ := changes.Subscribe(1)
+	defer cancel()
+
+	stored, _ := store.GetByID(ctx, "Eve")
+	if last := backlog[len(backlog)-1]; last.Record.Active != stored.Active {
+		t.Errorf("last change %+v, stored %+v", *last.Record, stored)
+	}
+}
+
+func TestChangeLogClose(t *testing.T) {
+	changes := NewChangeLog[testUser](3, nil)
+	_, before, cancel, _ := changes.Subscribe(0)
+	defer cancel()
+
+	changes.Close()
+	if _, ok := <-before; ok {
+		t.Error("subscription open after Close")
+	}
+
+	_, after, cancel, _ := changes.Subscribe(0)
+	defer cancel()
+	if _, ok := <-after; ok {
+		t.Error("subscription made after Close is open")
+	}
+}
+
+func TestChangesStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+
+	changes := NewChangeLog(10, func(u testUser) string { return u.Username })
+	RegisterResource(&r.RouterGroup, "/users", Observe[testUser](newTestUsers(), changes))
+	RegisterChanges(&r.RouterGroup, "/users/changes", changes)
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	http.Post(srv.URL+"/users", "application/json", strings.NewReader(`{"username":"Bob"}`))
+	req, _ := http.NewRequest("DELETE", srv.URL+"/users/Eve", nil)
+	http.DefaultClient.Do(req)
+
+	// Reconnecting after the first change.
+	req, _ = http.NewRequest("GET", srv.URL+"/users/changes", nil)
+	req.Header.Set("Last-Event-ID", changes.eventID(1))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+
+	req, _ = http.NewRequest("PATCH", srv.URL+"/users/Adam", strings.NewReader(`{"active":true}`))
+	http.DefaultClient.Do(req)
+
+	lines := bufio.NewScanner(res.Body)
+	events := []string{}
+	for lines.Scan() && len(events) < 2 {
+		if event, ok := strings.CutPrefix(lines.Text(), "event:"); ok {
+			events = append(events, event)
+		}
+	}
+
+	if got := strings.Join(events, " "); got != "deleted updated" {
+		t.Errorf("events %q", got)
+	}
+}
+
+func TestChangesStreamAfterRestart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+
+	before := NewChangeLog[testUser](10, nil)
+	changes := NewChangeLog[testUser](10, nil)
+	changes.epoch = before.epoch + "x"
+	changes.publish(Change[testUser]{Type: ChangeDeleted, ID: "Adam"})
+	changes.publish(Change[testUser]{Type: ChangeDeleted, ID: "Eve"})
+	changes.Close()
+	RegisterChanges(&r.RouterGroup, "/users/changes", changes)
+
+	for id, want := range map[string]string{
+		changes.eventID(1): "deleted",
+		before.eventID(1):  "reset",
+		"1":                "",
+	} {
+		w := do(r, "GET", "/users/changes?last_event_id="+id, "")
+
+		events := []string{}
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if event, ok := strings.CutPrefix(line, "event:"); ok {
+				events = append(events, event)
+			}
+		}
+		if got := strings.Join(events, " "); got != want {
+			t.Errorf("after %s: events %q, want %q", id, got, want)
+		}
+		if want == "" && w.Code != http.StatusBadRequest {
+			t.Errorf("after %s: status %d, want 400", id, w.Code)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+)
+
+// Media types the handlers can answer with, picked from
+// the Accept header. JSON is the default.
+const (
+	mediaJSON    = "application/json"
+	mediaCSV     = "text/csv"
+	mediaNDJSON  = "application/x-ndjson"
+	mediaMsgPack = "application/msgpack"
+)
+
+var mediaTypes = []string{mediaJSON, mediaCSV, mediaNDJSON, mediaMsgPack}
+
+// mediaAliases are other names clients use for the same formats.
+var mediaAliases = map[string]string{
+	"application/jsonl":       mediaNDJSON,
+	"application/ndjson":      mediaNDJSON,
+	"application/x-msgpack":   mediaMsgPack,
+	"application/vnd.msgpack": mediaMsgPack,
+}
+
+// flushEvery is how many rows the streaming encoders
+// write before flushing them to the client.
+const flushEvery = 100
+
+// wildcards are the media types a range stands for, by preference.
+var wildcards = map[string][]string{
+	"*/*":           mediaTypes,
+	"application/*": {mediaJSON, mediaNDJSON, mediaMsgPack},
+	"text/*":        {mediaCSV},
+}
+
+// mediaRange is one entry of an Accept header.
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// negotiate picks the media type preferred by the Accept header,
+// ok is false when none of the accepted types is supported. A
+// type given q=0 is refused even when a wider range accepts it.
+func negotiate(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return mediaJSON, true
+	}
+
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		if alias, ok := mediaAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+
+	// refused reports whether a range narrower than wildcard
+	// gives mediaType q=0.
+	refused := func(mediaType, wildcard string) bool {
+		for _, r := range ranges {
+			if r.q != 0 || r.mediaType == wildcard {
+				continue
+			}
+			if r.mediaType == mediaType || (wildcard == "*/*" && slices.Contains(wildcards[r.mediaType], mediaType)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	best, bestQ := "", 0.0
+	for _, r := range ranges {
+		if r.q <= bestQ {
+			continue
+		}
+
+		if slices.Contains(mediaTypes, r.mediaType) {
+			best, bestQ = r.mediaType, r.q
+			continue
+		}
+		for _, mediaType := range wildcards[r.mediaType] {
+			if !refused(mediaType, r.mediaType) {
+				best, bestQ = mediaType, r.q
+				break
+			}
+		}
+	}
+
+	return best, best != ""
+}
+
+// negotiateFormat picks the response format of ctx, or
+// answers 406 and returns false.
+func negotiateFormat(ctx *gin.Context) (string, bool) {
+	ctx.Header("Vary", "Accept")
+
+	mediaType, ok := negotiate(ctx.GetHeader("Accept"))
+	if !ok {
+		respondProblem(ctx, Problem{
+			Status: http.StatusNotAcceptable,
+			Detail: "supported media types are " + strings.Join(mediaTypes, ", "),
+		})
+	}
+
+	return mediaType, ok
+}
+
+// streamRecords writes records in mediaType one at a time, keeping
+// only fields when some are given. JSON is answered by respondCacheable.
+func streamRecords[T any](ctx *gin.Context, mediaType string, records []T, fields []string) error {
+	switch mediaType {
+	case mediaCSV:
+		return writeCSV(ctx, records, fields)
+	case mediaNDJSON:
+		return writeNDJSON(ctx, records, fields)
+	case mediaMsgPack:
+		return writeMsgPack(ctx, records, fields)
+	}
+	return fmt.Errorf("cannot stream %s", mediaType)
+}
+
+// row returns record as it is sent, projected on fields when given.
+func row[T any](record T, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return record, nil
+	}
+	return project(record, fields)
+}
+
+func writeNDJSON[T any](ctx *gin.Context, records []T, fields []string) error {
+	ctx.Header("Content-Type", mediaNDJSON)
+	ctx.Status(http.StatusOK)
+
+	enc := json.NewEncoder(ctx.Writer)
+	for i, record := range records {
+		r, err := row(record, fields)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+
+		if (i+1)%flushEvery == 0 {
+			ctx.Writer.Flush()
+		}
+	}
+
+	ctx.Writer.Flush()
+	return nil
+}
+
+func writeMsgPack[T any](ctx *gin.Context, records []T, fields []string) error {
+	ctx.Header("Content-Type", mediaMsgPack)
+	ctx.Status(http.StatusOK)
+
+	// Name the fields like the JSON responses do.
+	h := &codec.MsgpackHandle{}
+	h.TypeInfos = codec.NewTypeInfos([]string{"codec", "json"})
+	h.WriteExt = true
+
+	// The array header is written by hand so that the
+	// records can be encoded, and sent, one at a time.
+	if _, err := ctx.Writer.Write(msgpackArrayHeader(len(records))); err != nil {
+		return err
+	}
+
+	enc := codec.NewEncoder(ctx.Writer, h)
+	for i, record := range records {
+		r, err := row(record, fields)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+
+		if (i+1)%flushEvery == 0 {
+			ctx.Writer.Flush()
+		}
+	}
+
+	ctx.Writer.Flush()
+	return nil
+}
+
+func msgpackArrayHeader(n int) []byte {
+	switch {
+	case n < 16:
+		return []byte{0x90 | byte(n)}
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{0xdc}, uint16(n))
+	}
+	return binary.BigEndian.AppendUint32([]byte{0xdd}, uint32(n))
+}
+
+// writeCSV writes a header line with the JSON names of the
+// columns, then a line per record. Nested values are JSON.
+func writeCSV[T any](ctx *gin.Context, records []T, fields []string) error {
+	t := reflect.TypeFor[T]()
+	all := fieldsOf(t)
+
+	columns := fields
+	if len(columns) == 0 {
+		columns = orderedFields(all)
+	}
+
+	ctx.Header("Content-Type", mediaCSV+"; charset=utf-8")
+	ctx.Status(http.StatusOK)
+
+	w := csv.NewWriter(ctx.Writer)
+
+	if len(all) == 0 {
+		// Not a struct, a single column of values.
+		if err := w.Write([]string{"value"}); err != nil {
+			return err
+		}
+		for i, record := range records {
+			if err := w.Write([]string{csvValue(reflect.ValueOf(record))}); err != nil {
+				return err
+			}
+			flushCSV(ctx, w, i)
+		}
+		w.Flush()
+		return w.Error()
+	}
+
+	if err := w.Write(columns); err != nil {
+		return err
+	}
+
+	line := make([]string, len(columns))
+	for i, record := range records {
+		v := reflect.ValueOf(record)
+		for j, name := range columns {
+			line[j] = ""
+			if fv, ok := fieldValue(v, all[name]); ok {
+				line[j] = csvValue(fv)
+			}
+		}
+
+		if err := w.Write(line); err != nil {
+			return err
+		}
+		flushCSV(ctx, w, i)
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func flushCSV(ctx *gin.Context, w *csv.Writer, i int) {
+	if (i+1)%flushEvery == 0 {
+		w.Flush()
+		ctx.Writer.Flush()
+	}
+}
+
+// orderedFields lists the JSON names of fields in declaration order.
+func orderedFields(fields map[string]structField) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+
+	slices.SortFunc(names, func(a, b string) int {
+		return slices.Compare(fields[a].Index, fields[b].Index)
+	})
+
+	return names
+}
+
+// csvText keeps spreadsheets from running text as a formula,
+// text starting like one is prefixed with a quote.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func csvValue(v reflect.Value) string {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return csvText(v.String())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits())
+	}
+
+	if !v.CanInterface() {
+		// promoted through an unexported embedded struct
+		return ""
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.Format(time.RFC3339)
+	}
+
+	raw, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprint(v.Interface())
+	}
+	return string(raw)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"":                                     mediaJSON,
+		"*/*":                                  mediaJSON,
+		"text/csv":                             mediaCSV,
+		"application/json;q=0.5, text/csv":     mediaCSV,
+		"text/csv;q=0.2, application/x-ndjson": mediaNDJSON,
+		"application/x-msgpack":                mediaMsgPack,
+		"image/png":                            "",
+		"application/json;q=0, */*":            mediaCSV,
+		"*/*, text/csv;q=0, application/*;q=0": "",
+		"text/csv;q=0, text/*":                 "",
+		"application/*;q=0, text/csv;q=0.1":    mediaCSV,
+	}
+
+	for accept, want := range cases {
+		if got, _ := negotiate(accept); got != want {
+			t.Errorf("%q: got %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestListFormats(t *testing.T) {
+	users := newTestUsers()
+	for i := 0; i < 150; i++ {
+		users.Db = append(users.Db, testUser{Username: strings.Repeat("x", i+1)})
+	}
+	r := newTestRouter(users)
+
+	// Exports are not cut at the default page size.
+	w := do(r, "GET", "/users?sort=username", "", "Accept", "text/csv")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || len(lines) != 153 || lines[0] != "username,active" || lines[1] != "Adam,false" {
+		t.Fatalf("csv: status %d, %d lines starting with %q", w.Code, len(lines), lines[:2])
+	}
+
+	w = do(r, "GET", "/users?limit=2&fields=username", "", "Accept", "application/x-ndjson")
+	if got := w.Body.String(); got != "{\"username\":\"Adam\"}\n{\"username\":\"Eve\"}\n" {
+		t.Errorf("ndjson: %q", got)
+	}
+
+	w = do(r, "GET", "/users?limit=20", "", "Accept", "application/msgpack")
+	got := []map[string]any{}
+	h := &codec.MsgpackHandle{}
+	h.RawToString = true
+	if err := codec.NewDecoder(bytes.NewReader(w.Body.Bytes()), h).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 20 || got[1]["username"] != "Eve" || got[1]["active"] != true {
+		t.Errorf("msgpack: %d records, second %v", len(got), got[1])
+	}
+
+	if w := do(r, "GET", "/users", "", "Accept", "image/png"); w.Code != http.StatusNotAcceptable {
+		t.Errorf("unsupported type: status %d, want 406", w.Code)
+	}
+}
+
+func TestCSVFormulas(t *testing.T) {
+	users := &SliceDb[testUser]{Key: func(u testUser) string { return u.Username }}
+	for _, name := range []string{"=1+1", "+1", "-1", "@SUM(A1)", "Adam"} {
+		users.Add(context.Background(), testUser{Username: name})
+	}
+	r := newTestRouter(users)
+
+	w := do(r, "GET", "/users?fields=username", "", "Accept", "text/csv")
+	want := "username\n'=1+1\n'+1\n'-1\n'@SUM(A1)\nAdam\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("csv %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Records are tagged with their version when the DAO is Versioned,
+// with a hash of their JSON form otherwise. Lists are always tagged
+// with a hash of the response.
+
+func versionETag(version uint64) string {
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// matchETags reports whether etag is in the If-Match or If-None-Match
+// header. Weak tags only match with the weak comparison of GET.
+func matchETags(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+
+		if t, ok := strings.CutPrefix(tag, "W/"); ok {
+			if !weak {
+				continue
+			}
+			tag = t
+		}
+
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRecord fetches the record id with its entity tag, and
+// its version when d is Versioned, AnyVersion otherwise.
+func loadRecord[T any](ctx context.Context, d DAO[T], id string) (T, string, uint64, error) {
+	if v, ok := d.(Versioned[T]); ok {
+		record, version, err := v.GetVersion(ctx, id)
+		return record, versionETag(version), version, err
+	}
+
+	record, err := d.GetByID(ctx, id)
+	if err != nil {
+		return record, "", AnyVersion, err
+	}
+
+	body, err := json.Marshal(record)
+	return record, contentETag(body), AnyVersion, err
+}
+
+// storeRecord replaces the record id when it is still at version,
+// leaves the stored record in record and returns its new entity tag.
+// Only Versioned DAOs write at a version, see conditional.
+func storeRecord[T any](ctx context.Context, d DAO[T], id string, version uint64, record *T) (string, error) {
+	next, err := updateRecord(ctx, d, id, version, record)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := d.(Versioned[T]); ok {
+		return versionETag(next), nil
+	}
+	body, err := json.Marshal(record)
+	return contentETag(body), err
+}
+
+// removeRecord deletes the record id when it is still at version.
+func removeRecord[T any](ctx context.Context, d DAO[T], id string, version uint64) error {
+	if v, ok := d.(Versioned[T]); ok {
+		return v.DeleteVersion(ctx, id, version)
+	}
+	return d.Delete(ctx, id)
+}
+
+// ifMatch checks the If-Match header of a write to the record id.
+// It returns the version the write must apply to, AnyVersion when
+// the header is missing.
+func ifMatch[T any](ctx *gin.Context, d DAO[T], id string) (uint64, error) {
+	header := ctx.GetHeader("If-Match")
+	if header == "" {
+		return AnyVersion, nil
+	}
+
+	if err := conditional(d); err != nil {
+		return AnyVersion, err
+	}
+
+	_, etag, version, err := loadRecord(ctx.Request.Context(), d, id)
+	return matchRecord(header, id, etag, version, err)
+}
+
+// conditional fails unless d is Versioned: the other DAOs cannot
+// check the record and write it at once, so If-Match is refused
+// rather than checked before a write that may not see the same
+// record.
+func conditional[T any](d DAO[T]) error {
+	if _, ok := d.(Versioned[T]); !ok {
+		return fmt.Errorf("If-Match needs a versioned store: %w", errors.ErrUnsupported)
+	}
+	return nil
+}
+
+// matchRecord checks the If-Match header against the record id,
+// loaded with etag and version or failed with err. A missing record
+// matches no tag, * included (RFC 9110, section 13.1.1).
+func matchRecord(header, id, etag string, version uint64, err error) (uint64, error) {
+	var notFound *NotFoundError
+	switch {
+	case errors.As(err, &notFound):
+		return AnyVersion, &PreconditionFailedError{ID: id}
+	case err != nil:
+		return version, err
+	case !matchETags(header, etag, false):
+		return version, &PreconditionFailedError{ID: id, Version: version}
+	}
+	return version, nil
+}
+
+// respondCacheable writes body as JSON tagged with its hash,
+// or 304 when the client already has it.
+func respondCacheable(ctx *gin.Context, body any) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	etag := contentETag(raw)
+	ctx.Header("ETag", etag)
+
+	if matchETags(ctx.GetHeader("If-None-Match"), etag, true) {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", raw)
+}
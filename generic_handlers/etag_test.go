@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestETags(t *testing.T) {
+	r := newTestRouter(newTestUsers())
+
+	w := do(r, "GET", "/users/Eve", "")
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	if w := do(r, "GET", "/users/Eve", "", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status %d, want 304", w.Code)
+	}
+
+	w = do(r, "PATCH", "/users/Eve", `{"active":false}`, "If-Match", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH: status %d: %s", w.Code, w.Body)
+	}
+	next := w.Header().Get("ETag")
+	if next == "" || next == etag {
+		t.Fatalf("ETag %q after update, was %q", next, etag)
+	}
+
+	// A second editor still holding the old ETag.
+	if w := do(r, "PUT", "/users/Eve", `{"username":"Eve","active":true}`, "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale PUT: status %d, want 412", w.Code)
+	}
+	if w := do(r, "DELETE", "/users/Eve", "", "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale DELETE: status %d, want 412", w.Code)
+	}
+	if w := do(r, "DELETE", "/users/Eve", "", "If-Match", next); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: status %d, want 204", w.Code)
+	}
+
+	w = do(r, "GET", "/users", "")
+	list := w.Header().Get("ETag")
+	if w := do(r, "GET", "/users", "", "If-None-Match", list); w.Code != http.StatusNotModified {
+		t.Errorf("list If-None-Match: status %d, want 304", w.Code)
+	}
+}
+
+func TestIfMatchMissingRecord(t *testing.T) {
+	r := newTestRouter(newTestUsers())
+
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		for _, tag := range []string{"*", `"v1"`} {
+			if w := do(r, method, "/users/Nobody", `{"username":"Nobody"}`, "If-Match", tag); w.Code != http.StatusPreconditionFailed {
+				t.Errorf("%s If-Match %s: status %d, want 412", method, tag, w.Code)
+			}
+		}
+	}
+
+	if w := do(r, "PATCH", "/users/Eve", `{"active":false}`, "If-Match", "*"); w.Code != http.StatusOK {
+		t.Errorf("If-Match * on a stored record: status %d, want 200", w.Code)
+	}
+}
+
+// plainUsers hides the versions of the records it stores.
+type plainUsers struct {
+	DAO[testUser]
+}
+
+func TestIfMatchUnversioned(t *testing.T) {
+	r := newTestRouter(plainUsers{newTestUsers()})
+
+	w := do(r, "GET", "/users/Eve", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET: status %d, ETag %q", w.Code, etag)
+	}
+
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		if w := do(r, method, "/users/Eve", `{"username":"Eve"}`, "If-Match", etag); w.Code != http.StatusNotImplemented {
+			t.Errorf("%s: status %d, want 501", method, w.Code)
+		}
+	}
+
+	if w := do(r, "PUT", "/users/Eve", `{"username":"Eve"}`); w.Code != http.StatusOK {
+		t.Errorf("unconditional PUT: status %d, want 200", w.Code)
+	}
+}
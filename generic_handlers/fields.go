@@ -0,0 +1,177 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// structField is a field of T as seen by API clients.
+type structField struct {
+	Name  string // JSON name
+	Index []int
+	Type  reflect.Type
+	// Hidden is set on the fields promoted through an unexported
+	// embedded struct, reflect refuses to Interface their values.
+	Hidden bool
+}
+
+// fieldsOf lists the exported fields of t by their JSON name,
+// following the encoding/json rules for tags and embedding.
+func fieldsOf(t reflect.Type) map[string]structField {
+	fields := map[string]structField{}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+
+		hidden := false
+		for i := 1; i < len(f.Index); i++ {
+			if !t.FieldByIndex(f.Index[:i]).IsExported() {
+				hidden = true
+			}
+		}
+
+		fields[name] = structField{Name: name, Index: f.Index, Type: f.Type, Hidden: hidden}
+	}
+
+	return fields
+}
+
+// lookupField finds a field by JSON name, falling back to a case
+// insensitive match. Of several such matches, the first name in
+// byte order wins, so the same field is found every time.
+func lookupField(fields map[string]structField, name string) (structField, bool) {
+	if f, ok := fields[name]; ok {
+		return f, true
+	}
+
+	match := ""
+	for key := range fields {
+		if strings.EqualFold(key, name) && (match == "" || key < match) {
+			match = key
+		}
+	}
+	if match == "" {
+		return structField{}, false
+	}
+
+	return fields[match], true
+}
+
+// scalar reports whether values of kind k are read without Interface.
+func scalar(k reflect.Kind) bool {
+	switch k {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// sortable reports whether compareValues orders the values of f.
+// Times and the other types compared through Interface are not,
+// when f is Hidden.
+func (f structField) sortable() bool {
+	return !f.Hidden || scalar(indirect(f.Type).Kind())
+}
+
+// compareValues orders two values of the same field, of a sortable
+// structField. Scalars are compared by kind, without Interface.
+func compareValues(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.String:
+		return cmp.Compare(a.String(), b.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp.Compare(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmp.Compare(a.Float(), b.Float())
+	case reflect.Bool:
+		switch {
+		case a.Bool() == b.Bool():
+			return 0
+		case a.Bool():
+			return 1
+		}
+		return -1
+	}
+
+	if !a.CanInterface() || !b.CanInterface() {
+		return 0
+	}
+	if t, ok := a.Interface().(time.Time); ok {
+		return t.Compare(b.Interface().(time.Time))
+	}
+	return cmp.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+}
+
+// exported returns v, or a copy of it that Interface accepts
+// when v is the scalar value of a Hidden field.
+func exported(v reflect.Value) reflect.Value {
+	if v.CanInterface() || !scalar(v.Kind()) {
+		return v
+	}
+
+	c := reflect.New(v.Type()).Elem()
+	switch {
+	case v.Kind() == reflect.String:
+		c.SetString(v.String())
+	case v.Kind() == reflect.Bool:
+		c.SetBool(v.Bool())
+	case v.CanInt():
+		c.SetInt(v.Int())
+	case v.CanUint():
+		c.SetUint(v.Uint())
+	case v.CanFloat():
+		c.SetFloat(v.Float())
+	}
+	return c
+}
+
+// fieldValue returns the field f of record, following pointers.
+// ok is false when a nil pointer is in the way.
+func fieldValue(record reflect.Value, f structField) (reflect.Value, bool) {
+	record = reflect.Indirect(record)
+	if !record.IsValid() {
+		return reflect.Value{}, false
+	}
+
+	v, err := record.FieldByIndexErr(f.Index)
+	if err != nil {
+		return reflect.Value{}, false
+	}
+
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+
+	return v, true
+}
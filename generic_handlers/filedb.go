@@ -0,0 +1,703 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SyncPolicy tells FileDb when to fsync its log.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs every write before it returns,
+	// an acknowledged write survives a power loss.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs every FileDbOptions.SyncInterval,
+	// a crash loses at most that much of writes.
+	SyncInterval
+	// SyncNever leaves flushing to the OS, writes survive
+	// a crash of the process but not of the machine.
+	SyncNever
+)
+
+// FileDbOptions tune a FileDb, the zero value is usable.
+type FileDbOptions[T any] struct {
+	// Key identifies records, like SliceDb.Key.
+	Key func(T) string
+	// Sync is the fsync policy, SyncAlways by default.
+	Sync SyncPolicy
+	// SyncInterval is the period of SyncInterval, 1s when zero.
+	SyncInterval time.Duration
+	// SnapshotEvery is how many log entries trigger a snapshot
+	// and the compaction of the log, 1000 when zero.
+	SnapshotEvery int
+}
+
+const (
+	logFile      = "log.jsonl"
+	snapshotFile = "snapshot.json"
+)
+
+// logEntry is a line of the log. A put replaces the record id, or
+// appends it when there is none, a delete removes it. The sequence
+// number of the entry becomes the version of the record. A batch
+// holds the entries of a Batch, on a single line so that a crash
+// keeps all of them or none; its number is the one of the last.
+type logEntry[T any] struct {
+	Seq    uint64        `json:"seq"`
+	Op     string        `json:"op"`
+	ID     string        `json:"id"`
+	Record *T            `json:"record,omitempty"`
+	Batch  []logEntry[T] `json:"batch,omitempty"`
+}
+
+type snapshot[T any] struct {
+	Seq     uint64               `json:"seq"`
+	Records []versionedRecord[T] `json:"records"`
+}
+
+type versionedRecord[T any] struct {
+	Version uint64 `json:"version"`
+	Record  T      `json:"record"`
+}
+
+// FileDb is a durable Versioned DAO. Writes are appended to a JSON
+// lines log in dir, every SnapshotEvery entries the records are saved
+// to a snapshot and the log starts over. Opening the directory
+// replays the log on top of the snapshot; a line torn by a crash at
+// the end of the log is dropped. FileDb is a Batcher, a batch is
+// logged as one entry so that it survives a crash whole or not at all.
+type FileDb[T any] struct {
+	dir  string
+	opts FileDbOptions[T]
+
+	mu sync.RWMutex
+	// records in the order they were created, a deleted record
+	// leaves a hole at version 0 until holes make half of them
+	records  []T
+	versions []uint64
+	holes    int
+	index    map[string]int
+	seq      uint64
+	log      *os.File
+	entries  int  // entries in the log
+	unsynced bool // writes not fsynced yet
+
+	// staging is set on the copy a Batch runs on,
+	// its writes are kept in staged and not logged.
+	staging bool
+	staged  []logEntry[T]
+
+	stop chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenFileDb opens the database in dir, creating it when needed.
+func OpenFileDb[T any](dir string, opts FileDbOptions[T]) (*FileDb[T], error) {
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.SnapshotEvery == 0 {
+		opts.SnapshotEvery = 1000
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	f := &FileDb[T]{
+		dir:   dir,
+		opts:  opts,
+		index: map[string]int{},
+	}
+
+	if err := f.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := f.replay(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		f.stop = make(chan struct{})
+		f.done = make(chan struct{})
+		go f.syncLoop()
+	}
+
+	return f, nil
+}
+
+func (f *FileDb[T]) key(record T) (string, error) {
+	return keyOf(f.opts.Key, record, "FileDbOptions.Key")
+}
+
+// live reports whether the record at i is not a hole.
+// Callers must hold f.mu.
+func (f *FileDb[T]) live(i int) bool {
+	return f.versions[i] != 0
+}
+
+// KeyOf returns the ID of record.
+func (f *FileDb[T]) KeyOf(record T) (string, error) {
+	return f.key(record)
+}
+
+func (f *FileDb[T]) loadSnapshot() error {
+	raw, err := os.ReadFile(filepath.Join(f.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	snap := snapshot[T]{}
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return fmt.Errorf("corrupted snapshot: %v", err)
+	}
+
+	f.seq = snap.Seq
+	for _, r := range snap.Records {
+		id, err := f.key(r.Record)
+		if err != nil {
+			return err
+		}
+		f.index[id] = len(f.records)
+		f.records = append(f.records, r.Record)
+		f.versions = append(f.versions, r.Version)
+	}
+
+	return nil
+}
+
+// replay applies the log entries newer than the snapshot,
+// and leaves the log open for appending.
+func (f *FileDb[T]) replay() error {
+	file, err := os.OpenFile(filepath.Join(f.dir, logFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(file)
+	offset := int64(0)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				// The process died in the middle of a write,
+				// the entry was never acknowledged.
+				log.Printf("filedb: dropping %d bytes torn from the end of the log", len(line))
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		entry := logEntry[T]{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if _, peekErr := r.Peek(1); errors.Is(peekErr, io.EOF) {
+				log.Printf("filedb: dropping an unreadable last log entry: %v", err)
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return err
+				}
+				break
+			}
+			file.Close()
+			return fmt.Errorf("corrupted log at byte %d: %v", offset, err)
+		}
+		offset += int64(len(line))
+
+		if entry.Seq <= f.seq {
+			// Already in the snapshot, the log
+			// was not reset before a crash.
+			continue
+		}
+		if err := f.apply(entry); err != nil {
+			file.Close()
+			return fmt.Errorf("log entry %d: %v", entry.Seq, err)
+		}
+		f.entries++
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	f.log = file
+	return nil
+}
+
+// closeHoles drops the deleted records from f.records, deletes
+// only do so once in a while to stay cheap.
+// Callers must hold f.mu for writing.
+func (f *FileDb[T]) closeHoles() {
+	n := 0
+	for i, version := range f.versions {
+		if version == 0 {
+			continue
+		}
+		id, _ := f.key(f.records[i])
+		f.records[n], f.versions[n] = f.records[i], version
+		f.index[id] = n
+		n++
+	}
+
+	clear(f.records[n:])
+	f.records, f.versions = f.records[:n], f.versions[:n]
+	f.holes = 0
+}
+
+// apply changes the records according to entry.
+// Callers must hold f.mu for writing.
+func (f *FileDb[T]) apply(entry logEntry[T]) error {
+	f.seq = entry.Seq
+	i, exists := f.index[entry.ID]
+
+	switch entry.Op {
+	case "put":
+		if entry.Record == nil {
+			return fmt.Errorf("put without a record")
+		}
+		newID, err := f.key(*entry.Record)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			i = len(f.records)
+			f.records = append(f.records, *entry.Record)
+			f.versions = append(f.versions, entry.Seq)
+		} else {
+			f.records[i] = *entry.Record
+			f.versions[i] = entry.Seq
+			delete(f.index, entry.ID)
+		}
+		f.index[newID] = i
+
+	case "batch":
+		for _, e := range entry.Batch {
+			if err := f.apply(e); err != nil {
+				return fmt.Errorf("batch entry %d: %v", e.Seq, err)
+			}
+		}
+		f.seq = entry.Seq
+
+	case "delete":
+		if !exists {
+			return fmt.Errorf("delete of missing record %q", entry.ID)
+		}
+		var zero T
+		f.records[i] = zero
+		f.versions[i] = 0
+		f.holes++
+		delete(f.index, entry.ID)
+		if f.holes > len(f.records)/2 {
+			f.closeHoles()
+		}
+
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+
+	return nil
+}
+
+// write logs entry, then applies it. Callers must hold f.mu for
+// writing and have checked that the entry applies cleanly.
+func (f *FileDb[T]) write(entry logEntry[T]) (uint64, error) {
+	entry.Seq = f.seq + 1
+
+	if f.staging {
+		if err := f.apply(entry); err != nil {
+			return 0, err
+		}
+		f.staged = append(f.staged, entry)
+		return entry.Seq, nil
+	}
+
+	if f.log == nil {
+		return 0, fmt.Errorf("filedb: closed")
+	}
+
+	if entry.Op == "batch" {
+		entry.Seq = entry.Batch[len(entry.Batch)-1].Seq
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+
+	if n, err := f.log.Write(line); err != nil {
+		// Do not leave half an entry for the next
+		// one to be appended to.
+		f.truncateTail(n)
+		return 0, err
+	}
+
+	switch f.opts.Sync {
+	case SyncAlways:
+		if err := f.log.Sync(); err != nil {
+			// The write is not acknowledged, it must
+			// not come back on the next start.
+			f.truncateTail(len(line))
+			return 0, err
+		}
+	case SyncInterval:
+		f.unsynced = true
+	}
+
+	if err := f.apply(entry); err != nil {
+		return 0, err
+	}
+	f.entries++
+
+	if f.entries >= f.opts.SnapshotEvery {
+		if err := f.compact(); err != nil {
+			// The log still has everything.
+			log.Printf("filedb: snapshot failed: %v", err)
+		}
+	}
+
+	return entry.Seq, nil
+}
+
+func (f *FileDb[T]) truncateTail(n int) {
+	offset, err := f.log.Seek(0, io.SeekCurrent)
+	if err == nil {
+		start := max(offset-int64(n), 0)
+		if err = f.log.Truncate(start); err == nil {
+			_, err = f.log.Seek(start, io.SeekStart)
+		}
+	}
+	if err != nil {
+		log.Printf("filedb: failed to clean a failed write: %v", err)
+	}
+}
+
+// Compact saves a snapshot of the records and starts a new log.
+func (f *FileDb[T]) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.log == nil {
+		return fmt.Errorf("filedb: closed")
+	}
+	return f.compact()
+}
+
+// compact writes the snapshot next to the old one and renames it in
+// place, only then the log is reset. A crash in between leaves a log
+// whose entries are all in the snapshot, replay skips them.
+// Callers must hold f.mu for writing.
+func (f *FileDb[T]) compact() error {
+	snap := snapshot[T]{Seq: f.seq, Records: make([]versionedRecord[T], 0, len(f.records)-f.holes)}
+	for i, record := range f.records {
+		if f.live(i) {
+			snap.Records = append(snap.Records, versionedRecord[T]{Version: f.versions[i], Record: record})
+		}
+	}
+
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(f.dir, snapshotFile), raw); err != nil {
+		return err
+	}
+
+	if err := writeFileSync(filepath.Join(f.dir, logFile), nil); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(f.dir, logFile), os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	f.log.Close()
+	f.log = file
+	f.entries = 0
+	f.unsynced = false
+
+	return nil
+}
+
+// writeFileSync atomically replaces path with data.
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, bytes.NewReader(data)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (f *FileDb[T]) syncLoop() {
+	defer close(f.done)
+
+	ticker := time.NewTicker(f.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			if f.unsynced && f.log != nil {
+				if err := f.log.Sync(); err != nil {
+					log.Printf("filedb: sync failed: %v", err)
+				} else {
+					f.unsynced = false
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// Close syncs and closes the log. Later calls return
+// the error of the first one.
+func (f *FileDb[T]) Close() error {
+	f.closeOnce.Do(func() {
+		f.closeErr = f.close()
+	})
+	return f.closeErr
+}
+
+func (f *FileDb[T]) close() error {
+	if f.stop != nil {
+		close(f.stop)
+		<-f.done
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.log == nil {
+		return nil
+	}
+
+	err := f.log.Sync()
+	if cerr := f.log.Close(); err == nil {
+		err = cerr
+	}
+	f.log = nil
+
+	return err
+}
+
+func (f *FileDb[T]) Add(ctx context.Context, record T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	id, err := f.key(record)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.index[id]; ok {
+		return &ConflictError{ID: id}
+	}
+
+	_, err = f.write(logEntry[T]{Op: "put", ID: id, Record: &record})
+	return err
+}
+
+func (f *FileDb[T]) Update(ctx context.Context, id string, data T) error {
+	_, err := f.UpdateVersion(ctx, id, AnyVersion, data)
+	return err
+}
+
+// UpdateVersion replaces the record id when it is at version,
+// and returns its new version.
+func (f *FileDb[T]) UpdateVersion(ctx context.Context, id string, version uint64, data T) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	newID, err := f.key(data)
+	if err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i, ok := f.index[id]
+	if !ok {
+		return 0, &NotFoundError{ID: id}
+	}
+	if version != AnyVersion && version != f.versions[i] {
+		return 0, &PreconditionFailedError{ID: id, Version: f.versions[i]}
+	}
+	if _, taken := f.index[newID]; newID != id && taken {
+		return 0, &ConflictError{ID: newID}
+	}
+
+	return f.write(logEntry[T]{Op: "put", ID: id, Record: &data})
+}
+
+// Get runs q. Queries read the records through Dump or
+// Filter, which take the lock.
+func (f *FileDb[T]) Get(ctx context.Context, q QueryFunc[T]) ([]T, error) {
+	return runQuery(ctx, q)
+}
+
+func (f *FileDb[T]) GetByID(ctx context.Context, id string) (T, error) {
+	return getByID[T](ctx, f, id)
+}
+
+// GetVersion returns the record id with its version.
+func (f *FileDb[T]) GetVersion(ctx context.Context, id string) (T, uint64, error) {
+	var record T
+
+	if err := ctx.Err(); err != nil {
+		return record, 0, err
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	i, ok := f.index[id]
+	if !ok {
+		return record, 0, &NotFoundError{ID: id}
+	}
+
+	return f.records[i], f.versions[i], nil
+}
+
+func (f *FileDb[T]) Delete(ctx context.Context, id string) error {
+	return f.DeleteVersion(ctx, id, AnyVersion)
+}
+
+// DeleteVersion deletes the record id when it is at version.
+func (f *FileDb[T]) DeleteVersion(ctx context.Context, id string, version uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i, ok := f.index[id]
+	if !ok {
+		return &NotFoundError{ID: id}
+	}
+	if version != AnyVersion && version != f.versions[i] {
+		return &PreconditionFailedError{ID: id, Version: f.versions[i]}
+	}
+
+	_, err := f.write(logEntry[T]{Op: "delete", ID: id})
+	return err
+}
+
+// Batch applies ops all or nothing. They run on a copy of the
+// records first, then the writes are logged as a single entry.
+func (f *FileDb[T]) Batch(ctx context.Context, ops []BatchOp[T]) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	tx := &FileDb[T]{
+		opts:     f.opts,
+		records:  slices.Clone(f.records),
+		versions: slices.Clone(f.versions),
+		holes:    f.holes,
+		index:    maps.Clone(f.index),
+		seq:      f.seq,
+		staging:  true,
+	}
+
+	for i, op := range ops {
+		if err := applyBatchOp[T](ctx, tx, op); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+
+	_, err := f.write(logEntry[T]{Op: "batch", Batch: tx.staged})
+	return err
+}
+
+// Dump returns a copy of every record.
+func (f *FileDb[T]) Dump(ctx context.Context) ([]T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return scan(ctx, f.records, f.live, func(T) bool { return true })
+}
+
+// Filter returns a query selecting the records matching keep.
+// Long scans stop when ctx is done.
+func (f *FileDb[T]) Filter(keep func(T) bool) QueryFunc[T] {
+	return func(ctx context.Context) ([]T, error) {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+
+		return scan(ctx, f.records, f.live, keep)
+	}
+}
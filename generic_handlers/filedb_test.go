@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func openTestFileDb(t *testing.T, dir string) *FileDb[testUser] {
+	t.Helper()
+
+	db, err := OpenFileDb(dir, FileDbOptions[testUser]{
+		Key:           func(u testUser) string { return u.Username },
+		SnapshotEvery: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestFileDbRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db := openTestFileDb(t, dir)
+	for _, name := range []string{"Adam", "Eve", "Bob", "Charlie", "Dan"} {
+		if err := db.Add(ctx, testUser{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Add(ctx, testUser{Username: "Eve"}); !errors.As(err, new(*ConflictError)) {
+		t.Fatalf("duplicate add: %v", err)
+	}
+	if err := db.Update(ctx, "Bob", testUser{Username: "Robert", Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(ctx, "Adam"); err != nil {
+		t.Fatal(err)
+	}
+	_, version, _ := db.GetVersion(ctx, "Robert")
+	db.Close()
+
+	// The fifth write went to a fresh log after a snapshot.
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile)); err != nil {
+		t.Fatalf("no snapshot: %v", err)
+	}
+
+	// A crash in the middle of the next write.
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.WriteString(`{"seq":99,"op":"put","id":"Mallory","rec`)
+	log.Close()
+
+	db = openTestFileDb(t, dir)
+	defer db.Close()
+
+	all, _ := db.Dump(ctx)
+	names := []string{}
+	for _, u := range all {
+		names = append(names, u.Username)
+	}
+	if got, want := names, []string{"Eve", "Robert", "Charlie", "Dan"}; !slices.Equal(got, want) {
+		t.Fatalf("after recovery %v, want %v", got, want)
+	}
+
+	if _, v, _ := db.GetVersion(ctx, "Robert"); v != version {
+		t.Errorf("version %d after recovery, was %d", v, version)
+	}
+	if _, err := db.UpdateVersion(ctx, "Robert", version-1, testUser{Username: "Robert"}); !errors.As(err, new(*PreconditionFailedError)) {
+		t.Errorf("stale update: %v", err)
+	}
+
+	// The torn entry is gone, new writes follow the last good one.
+	if err := db.Add(ctx, testUser{Username: "Mallory"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openTestFileDb(t, dir)
+	defer db.Close()
+	if _, err := db.GetByID(ctx, "Mallory"); err != nil {
+		t.Errorf("Mallory: %v", err)
+	}
+}
+
+func TestFileDbDeletesKeepOrder(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db := openTestFileDb(t, dir)
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, name := range names {
+		db.Add(ctx, testUser{Username: name})
+	}
+
+	db.Delete(ctx, "b")
+	db.Delete(ctx, "d")
+	if all, _ := db.Dump(ctx); len(all) != 6 || all[1].Username != "c" {
+		t.Errorf("with holes: %v", all)
+	}
+
+	// enough deletes to compact the holes they leave
+	for _, name := range []string{"e", "g", "h"} {
+		if err := db.Delete(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Add(ctx, testUser{Username: "d", Active: true})
+
+	check := func(when string) {
+		all, _ := db.Dump(ctx)
+		got := []string{}
+		for _, u := range all {
+			got = append(got, u.Username)
+		}
+		if want := []string{"a", "c", "f", "d"}; !slices.Equal(got, want) {
+			t.Errorf("%s: %v, want %v", when, got, want)
+		}
+
+		for _, name := range got {
+			if u, err := db.GetByID(ctx, name); err != nil || u.Username != name {
+				t.Errorf("%s: GetByID(%q) = %v, %v", when, name, u, err)
+			}
+		}
+		if _, err := db.GetByID(ctx, "b"); !errors.As(err, new(*NotFoundError)) {
+			t.Errorf("%s: deleted record: %v", when, err)
+		}
+
+		active, _ := db.Filter(func(u testUser) bool { return !u.Active })(ctx)
+		if len(active) != 3 {
+			t.Errorf("%s: filter found %d records, want 3", when, len(active))
+		}
+	}
+
+	check("before reopening")
+	db.Close()
+	db = openTestFileDb(t, dir)
+	defer db.Close()
+	check("after reopening")
+}
+
+func TestFileDbCloseTwice(t *testing.T) {
+	db, err := OpenFileDb(t.TempDir(), FileDbOptions[testUser]{
+		Key:  func(u testUser) string { return u.Username },
+		Sync: SyncInterval,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add(context.Background(), testUser{Username: "Adam"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := db.Close(); err != nil {
+		t.Errorf("closing a closed database: %v", err)
+	}
+}
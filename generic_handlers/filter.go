@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// filter is one condition of the query string, the filter
+// ?points[gt]=100 keeps the records with more than 100 points.
+type filter struct {
+	field  structField
+	op     string
+	values []reflect.Value
+}
+
+// Supported filter operators, eq when none is given.
+// contains, prefix and suffix only apply to strings,
+// gt, gte, lt and lte to ordered types.
+var filterOps = map[string]func(c int, s, v string) bool{
+	"eq":       func(c int, _, _ string) bool { return c == 0 },
+	"ne":       func(c int, _, _ string) bool { return c != 0 },
+	"gt":       func(c int, _, _ string) bool { return c > 0 },
+	"gte":      func(c int, _, _ string) bool { return c >= 0 },
+	"lt":       func(c int, _, _ string) bool { return c < 0 },
+	"lte":      func(c int, _, _ string) bool { return c <= 0 },
+	"in":       func(c int, _, _ string) bool { return c == 0 },
+	"contains": func(_ int, s, v string) bool { return strings.Contains(s, v) },
+	"prefix":   func(_ int, s, v string) bool { return strings.HasPrefix(s, v) },
+	"suffix":   func(_ int, s, v string) bool { return strings.HasSuffix(s, v) },
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// parseFilters reads the filters of q for records of type T,
+// list parameters like limit or sort are skipped.
+func parseFilters[T any](q url.Values) ([]filter, error) {
+	fields := fieldsOf(reflect.TypeFor[T]())
+	filters := []filter{}
+
+	for key, values := range q {
+		if slices.Contains(listParams, key) {
+			continue
+		}
+
+		name, op := key, "eq"
+		if i := strings.IndexByte(key, '['); i > 0 && strings.HasSuffix(key, "]") {
+			name, op = key[:i], key[i+1:len(key)-1]
+		}
+
+		f, ok := lookupField(fields, name)
+		if !ok {
+			return nil, fmt.Errorf("cannot filter on unknown field %q", name)
+		}
+		if !f.filterable() {
+			return nil, fmt.Errorf("cannot filter on field %q", f.Name)
+		}
+
+		if _, ok := filterOps[op]; !ok {
+			return nil, fmt.Errorf("unknown operator %q for field %q", op, f.Name)
+		}
+
+		t := f.Type
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+
+		switch op {
+		case "contains", "prefix", "suffix":
+			if t.Kind() != reflect.String {
+				return nil, fmt.Errorf("operator %q only applies to text, %q is %s", op, f.Name, t)
+			}
+		case "gt", "gte", "lt", "lte":
+			if t.Kind() == reflect.Bool {
+				return nil, fmt.Errorf("operator %q does not apply to %q", op, f.Name)
+			}
+		}
+
+		for _, raw := range values {
+			parts := []string{raw}
+			if op == "in" {
+				parts = strings.Split(raw, ",")
+			}
+
+			fl := filter{field: f, op: op}
+			for _, part := range parts {
+				v, err := parseValue(t, part)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value %q for field %q: %v", part, f.Name, err)
+				}
+				fl.values = append(fl.values, v)
+			}
+			filters = append(filters, fl)
+		}
+	}
+
+	return filters, nil
+}
+
+// filterable reports whether fields of type t can be filtered on.
+func filterable(t reflect.Type) bool {
+	if t == timeType {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// filterable reports whether records can be filtered on f.
+func (f structField) filterable() bool {
+	return filterable(indirect(f.Type)) && f.sortable()
+}
+
+// parseValue converts s to a value of type t.
+func parseValue(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+
+	if t == timeType {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return v, fmt.Errorf("want an RFC 3339 time")
+		}
+		v.Set(reflect.ValueOf(tm))
+		return v, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, fmt.Errorf("want true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("want an integer")
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("want a positive integer")
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("want a number")
+		}
+		v.SetFloat(f)
+	default:
+		return v, fmt.Errorf("%s fields cannot be filtered", t)
+	}
+
+	return v, nil
+}
+
+// match reports whether record passes the filter,
+// records with a nil field never do.
+func (f filter) match(record reflect.Value) bool {
+	v, ok := fieldValue(record, f.field)
+	if !ok {
+		return false
+	}
+
+	test := filterOps[f.op]
+	for _, want := range f.values {
+		s, ws := "", ""
+		if v.Kind() == reflect.String {
+			s, ws = v.String(), want.String()
+		}
+
+		if test(compareValues(v, want), s, ws) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchFilters returns a predicate keeping the records passing all filters.
+func matchFilters[T any](filters []filter) func(T) bool {
+	return func(record T) bool {
+		v := reflect.ValueOf(record)
+		for _, f := range filters {
+			if !f.match(v) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// filterQuery returns a query selecting the records of d matching
+// keep. It reads them through d, wrappers like WithHooks apply.
+func filterQuery[T any](d DAO[T], keep func(T) bool) QueryFunc[T] {
+	return func(ctx context.Context) ([]T, error) {
+		records, err := d.Dump(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return scan(ctx, records, nil, keep)
+	}
+}
+
+// FilterRecords lists the records of d matching the filters
+// of the query string, built from the fields of T:
+//
+//	?username[contains]=b&active=true&points[gt]=100
+//
+// The list parameters of listOptions apply to the result.
+func FilterRecords[T any](d DAO[T]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		query := ctx.Request.URL.Query()
+
+		opts, err := parseListOptions[T](query)
+		if err != nil {
+			respondError(ctx, &BadRequestError{Err: err})
+			return
+		}
+
+		filters, err := parseFilters[T](query)
+		if err != nil {
+			respondError(ctx, &BadRequestError{Err: err})
+			return
+		}
+		keep := matchFilters[T](filters)
+
+		results, err := d.Get(ctx.Request.Context(), filterQuery(d, keep))
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		respondList(ctx, d, results, opts)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type scoredUser struct {
+	Username string  `json:"username"`
+	Active   bool    `json:"active"`
+	Points   int     `json:"points"`
+	Team     *string `json:"team"`
+	Address  struct {
+		City string `json:"city"`
+	} `json:"address"`
+}
+
+func TestFilterRecords(t *testing.T) {
+	red := "red"
+	users := &SliceDb[scoredUser]{
+		Key: func(u scoredUser) string { return u.Username },
+		Db: []scoredUser{
+			{Username: "Adam", Points: 40},
+			{Username: "bob", Active: true, Points: 120, Team: &red},
+			{Username: "Abby", Active: true, Points: 250},
+			{Username: "Eve", Active: true, Points: 90},
+		},
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(&r.RouterGroup, "/scored", users)
+
+	cases := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"username[contains]=b&active=true&points[gt]=100", http.StatusOK, "[bob Abby]"},
+		{"Points[lte]=90&sort=-points", http.StatusOK, "[Eve Adam]"},
+		{"username[in]=Adam,Eve", http.StatusOK, "[Adam Eve]"},
+		{"team=red", http.StatusOK, "[bob]"},
+		{"nope=1", http.StatusBadRequest, ""},
+		{"points=many", http.StatusBadRequest, ""},
+		{"points[contains]=1", http.StatusBadRequest, ""},
+		{"active[gt]=true", http.StatusBadRequest, ""},
+		{"username[like]=a", http.StatusBadRequest, ""},
+	}
+
+	for _, c := range cases {
+		w := do(r, "GET", "/scored?"+c.query, "")
+		if w.Code != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.query, w.Code, c.status, w.Body)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+
+		got := []scoredUser{}
+		json.Unmarshal(w.Body.Bytes(), &got)
+		names := []string{}
+		for _, u := range got {
+			names = append(names, u.Username)
+		}
+		if s := fmt.Sprint(names); s != c.want {
+			t.Errorf("%s: got %s, want %s", c.query, s, c.want)
+		}
+	}
+
+	// struct fields are refused before their value is parsed
+	w := do(r, "GET", "/scored?address=Paris", "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `cannot filter on field \"address\"`) {
+		t.Errorf("struct field: %d %s", w.Code, w.Body)
+	}
+}
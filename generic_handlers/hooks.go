@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hooks customize the writes of a DAO, see WithHooks.
+// A Before hook vetoes the write by returning an error.
+type Hooks[T any] struct {
+	// BeforeCreate may change the record before it is added.
+	BeforeCreate func(ctx context.Context, record *T) error
+	// AfterCreate runs once the record was added.
+	AfterCreate func(ctx context.Context, record T)
+	// BeforeUpdate gets the stored record and may change the new one.
+	BeforeUpdate func(ctx context.Context, id string, old T, record *T) error
+	// BeforeDelete gets the record about to be deleted.
+	BeforeDelete func(ctx context.Context, id string, record T) error
+
+	// Audit, when set, gets an entry for every write.
+	Audit *AuditLog[T]
+	// Key gives the ID of created records for the audit trail,
+	// Identifiable records do without.
+	Key func(T) string
+
+	// SoftDelete is the JSON name of a time.Time or *time.Time field.
+	// When set, deletes stamp the field instead of removing the record,
+	// and stamped records are hidden unless the context comes from
+	// WithDeleted. Clients cannot set the field, nor write to deleted
+	// records, whose IDs stay taken.
+	SoftDelete string
+}
+
+// VetoError is returned when a hook refused a write.
+type VetoError struct {
+	ID  string
+	Err error
+}
+
+func (e *VetoError) Error() string {
+	return fmt.Sprintf("write to %q refused: %v", e.ID, e.Err)
+}
+
+func (e *VetoError) Unwrap() error {
+	return e.Err
+}
+
+type includeDeletedKey struct{}
+
+// WithDeleted returns a context in which soft deleted records are visible.
+func WithDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeDeletedKey{}, true)
+}
+
+func includesDeleted(ctx context.Context) bool {
+	include, _ := ctx.Value(includeDeletedKey{}).(bool)
+	return include
+}
+
+// IncludeDeleted shows soft deleted records to the
+// requests it handles when they pass ?include_deleted=true.
+func IncludeDeleted() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		param, ok := ctx.GetQuery("include_deleted")
+		if !ok {
+			ctx.Next()
+			return
+		}
+
+		include, err := strconv.ParseBool(param)
+		if err != nil {
+			respondError(ctx, &BadRequestError{Err: fmt.Errorf("include_deleted: %v", err)})
+			ctx.Abort()
+			return
+		}
+
+		if include {
+			ctx.Request = ctx.Request.WithContext(WithDeleted(ctx.Request.Context()))
+		}
+		ctx.Next()
+	}
+}
+
+// WithHooks wraps d so that its writes run hooks. The wrapper is
+// Versioned when d is, and applies batches when d is a Batcher; the
+// hooks of an operation of a batch see the records as the operations
+// before it left them. It panics when hooks.SoftDelete is not a time
+// field of T. Soft deletes reach d as updates, wrap the result, not
+// d, with Observe to publish them as deletes.
+//
+// Writes apply to the records the hooks saw. When d is Versioned they
+// are made at the version that was read, and rerun from the read when
+// another write got in between, unless the caller asked for a version.
+// Otherwise the writes of the wrapper are serialized, the hooks run
+// under its lock and must not write to it.
+func WithHooks[T any](d DAO[T], hooks Hooks[T]) DAO[T] {
+	h := &hooked[T]{DAO: d, hooks: hooks}
+
+	if hooks.SoftDelete != "" {
+		t := reflect.TypeFor[T]()
+		f, ok := lookupField(fieldsOf(t), hooks.SoftDelete)
+		if t.Kind() != reflect.Struct || !ok || indirect(f.Type) != timeType {
+			panic(fmt.Sprintf("WithHooks: %s has no time field %q", t, hooks.SoftDelete))
+		}
+		h.deleted = &f
+	}
+
+	if v, ok := d.(Versioned[T]); ok {
+		h.versioned = v
+		return &hookedVersioned[T]{hooked: h}
+	}
+	return h
+}
+
+type hooked[T any] struct {
+	DAO[T]
+	hooks     Hooks[T]
+	versioned Versioned[T] // nil when d is not Versioned
+	deleted   *structField // the soft delete stamp
+
+	mu sync.Mutex // serializes the writes when d is not Versioned
+}
+
+// writeAttempts bounds the reruns of a write losing to others.
+const writeAttempts = 5
+
+// lock serializes the writes to a DAO that cannot make them conditional.
+func (h *hooked[T]) lock() (unlock func()) {
+	if h.versioned != nil {
+		return func() {}
+	}
+	h.mu.Lock()
+	return h.mu.Unlock
+}
+
+// retry tells whether a write made at the version the hooks saw,
+// for a caller that asked for AnyVersion, lost to another write.
+func (h *hooked[T]) retry(err error, version uint64, attempt int) bool {
+	var precondition *PreconditionFailedError
+	return version == AnyVersion && attempt < writeAttempts && errors.As(err, &precondition)
+}
+
+func (h *hooked[T]) keyOf(record T) string {
+	if h.hooks.Key != nil {
+		return h.hooks.Key(record)
+	}
+	if r, ok := any(record).(Identifiable); ok {
+		return r.ID()
+	}
+	return ""
+}
+
+func (h *hooked[T]) KeyOf(record T) (string, error) {
+	if h.hooks.Key != nil {
+		return h.hooks.Key(record), nil
+	}
+	return recordKey(h.DAO, record)
+}
+
+func (h *hooked[T]) isDeleted(record T) bool {
+	if h.deleted == nil {
+		return false
+	}
+	v, ok := fieldValue(reflect.ValueOf(record), *h.deleted)
+	return ok && !v.IsZero()
+}
+
+// stamp sets the soft delete stamp of record, a zero time clears it.
+func (h *hooked[T]) stamp(record *T, at time.Time) {
+	if h.deleted == nil {
+		return
+	}
+
+	v, err := reflect.ValueOf(record).Elem().FieldByIndexErr(h.deleted.Index)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case at.IsZero():
+		v.SetZero()
+	case v.Kind() == reflect.Pointer:
+		v.Set(reflect.ValueOf(&at))
+	default:
+		v.Set(reflect.ValueOf(at))
+	}
+}
+
+// visible drops the soft deleted records, unless ctx includes them.
+func (h *hooked[T]) visible(ctx context.Context, records []T) []T {
+	if h.deleted == nil || includesDeleted(ctx) {
+		return records
+	}
+
+	kept := make([]T, 0, len(records))
+	for _, record := range records {
+		if !h.isDeleted(record) {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
+
+// load returns the record id with its version, AnyVersion
+// when d is not Versioned. Deleted records are not found.
+func (h *hooked[T]) load(ctx context.Context, id string) (T, uint64, error) {
+	var record T
+	var version uint64
+	var err error
+
+	if h.versioned != nil {
+		record, version, err = h.versioned.GetVersion(ctx, id)
+	} else {
+		record, err = h.DAO.GetByID(ctx, id)
+	}
+	if err != nil {
+		return record, version, err
+	}
+
+	if h.isDeleted(record) && !includesDeleted(ctx) {
+		var zero T
+		return zero, AnyVersion, &NotFoundError{ID: id}
+	}
+	return record, version, nil
+}
+
+// loadAt loads the record id to write at version. It returns the
+// version the write must apply to: the one that was read, AnyVersion
+// when d is not Versioned.
+func (h *hooked[T]) loadAt(ctx context.Context, id string, version uint64) (T, uint64, error) {
+	record, current, err := h.load(ctx, id)
+	if err != nil {
+		return record, current, err
+	}
+	if version != AnyVersion && version != current {
+		var zero T
+		return zero, current, &PreconditionFailedError{ID: id, Version: current}
+	}
+	return record, current, nil
+}
+
+func (h *hooked[T]) store(ctx context.Context, id string, version uint64, record T) (uint64, error) {
+	if h.versioned != nil {
+		return h.versioned.UpdateVersion(ctx, id, version, record)
+	}
+	return AnyVersion, h.DAO.Update(ctx, id, record)
+}
+
+func (h *hooked[T]) beforeCreate(ctx context.Context, record *T) error {
+	h.stamp(record, time.Time{})
+
+	if before := h.hooks.BeforeCreate; before != nil {
+		if err := before(ctx, record); err != nil {
+			return &VetoError{ID: h.keyOf(*record), Err: err}
+		}
+	}
+	return nil
+}
+
+func (h *hooked[T]) afterCreate(ctx context.Context, record T) {
+	h.hooks.Audit.record(ctx, ChangeCreated, h.keyOf(record), nil, &record)
+
+	if after := h.hooks.AfterCreate; after != nil {
+		after(ctx, record)
+	}
+}
+
+// beforeUpdate runs the hooks of the update of old, stored as id.
+func (h *hooked[T]) beforeUpdate(ctx context.Context, id string, old T, record *T) error {
+	h.stamp(record, time.Time{})
+
+	if before := h.hooks.BeforeUpdate; before != nil {
+		if err := before(ctx, id, old, record); err != nil {
+			return &VetoError{ID: id, Err: err}
+		}
+	}
+	return nil
+}
+
+// beforeDelete runs the hooks of the delete of old, stored as id.
+// When deletes are soft, it returns the stamped record to store
+// in its place.
+func (h *hooked[T]) beforeDelete(ctx context.Context, id string, old T) (*T, error) {
+	if before := h.hooks.BeforeDelete; before != nil {
+		if err := before(ctx, id, old); err != nil {
+			return nil, &VetoError{ID: id, Err: err}
+		}
+	}
+
+	if h.deleted == nil {
+		return nil, nil
+	}
+	stamped := old
+	h.stamp(&stamped, time.Now().UTC())
+	return &stamped, nil
+}
+
+func (h *hooked[T]) Add(ctx context.Context, record T) error {
+	return h.AddRecord(ctx, &record)
+}
+
+// AddRecord leaves the record the hooks made in record, see Rewriter.
+func (h *hooked[T]) AddRecord(ctx context.Context, record *T) error {
+	if err := h.beforeCreate(ctx, record); err != nil {
+		return err
+	}
+
+	if err := h.DAO.Add(ctx, *record); err != nil {
+		return err
+	}
+
+	h.afterCreate(ctx, *record)
+	return nil
+}
+
+func (h *hooked[T]) Get(ctx context.Context, q QueryFunc[T]) ([]T, error) {
+	records, err := h.DAO.Get(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return h.visible(ctx, records), nil
+}
+
+func (h *hooked[T]) GetByID(ctx context.Context, id string) (T, error) {
+	record, _, err := h.load(ctx, id)
+	return record, err
+}
+
+func (h *hooked[T]) Dump(ctx context.Context) ([]T, error) {
+	records, err := h.DAO.Dump(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.visible(ctx, records), nil
+}
+
+func (h *hooked[T]) Update(ctx context.Context, id string, record T) error {
+	_, err := h.UpdateRecord(ctx, id, AnyVersion, &record)
+	return err
+}
+
+// UpdateRecord leaves the record the hooks made in record, see Rewriter.
+func (h *hooked[T]) UpdateRecord(ctx context.Context, id string, version uint64, record *T) (uint64, error) {
+	unlock := h.lock()
+	defer unlock()
+
+	given := *record
+	for attempt := 1; ; attempt++ {
+		old, at, err := h.loadAt(ctx, id, version)
+		if err != nil {
+			return 0, err
+		}
+
+		*record = given
+		if err := h.beforeUpdate(ctx, id, old, record); err != nil {
+			return 0, err
+		}
+
+		next, err := h.store(ctx, id, at, *record)
+		if h.retry(err, version, attempt) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		stored := *record
+		h.hooks.Audit.record(ctx, ChangeUpdated, id, &old, &stored)
+		return next, nil
+	}
+}
+
+func (h *hooked[T]) Delete(ctx context.Context, id string) error {
+	return h.delete(ctx, id, AnyVersion)
+}
+
+func (h *hooked[T]) delete(ctx context.Context, id string, version uint64) error {
+	unlock := h.lock()
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		old, at, err := h.loadAt(ctx, id, version)
+		if err != nil {
+			return err
+		}
+		stamped, err := h.beforeDelete(ctx, id, old)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case stamped != nil:
+			_, err = h.store(ctx, id, at, *stamped)
+		case h.versioned != nil:
+			err = h.versioned.DeleteVersion(ctx, id, at)
+		default:
+			err = h.DAO.Delete(ctx, id)
+		}
+		if h.retry(err, version, attempt) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		h.hooks.Audit.record(ctx, ChangeDeleted, id, &old, stamped)
+		return nil
+	}
+}
+
+// Batch runs the hooks of every operation, then applies the batch
+// and leaves the stored records in those of ops. Soft deletes are
+// sent to d as updates. The operations on records read from d are
+// made at the versions that were read, see WithHooks.
+func (h *hooked[T]) Batch(ctx context.Context, ops []BatchOp[T]) error {
+	b, ok := h.DAO.(Batcher[T])
+	if !ok {
+		return fmt.Errorf("batches: %w", errors.ErrUnsupported)
+	}
+
+	unlock := h.lock()
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		staged, olds, err := h.stage(ctx, ops)
+		if err != nil {
+			return err
+		}
+
+		err = b.Batch(ctx, staged)
+		var failed *BatchError
+		if errors.As(err, &failed) && failed.Index >= 0 && failed.Index < len(ops) &&
+			h.retry(failed.Err, ops[failed.Index].Version, attempt) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for i, op := range ops {
+			switch op.Op {
+			case BatchCreate:
+				*op.Record = *staged[i].Record
+				h.afterCreate(ctx, *staged[i].Record)
+			case BatchUpdate:
+				*op.Record = *staged[i].Record
+				h.hooks.Audit.record(ctx, ChangeUpdated, op.ID, &olds[i], staged[i].Record)
+			case BatchDelete:
+				h.hooks.Audit.record(ctx, ChangeDeleted, op.ID, &olds[i], staged[i].Record)
+			}
+		}
+		return nil
+	}
+}
+
+// stage runs the hooks of ops on copies of their records. It returns
+// the operations to send to d, and the records the updates and
+// deletes replace.
+func (h *hooked[T]) stage(ctx context.Context, ops []BatchOp[T]) ([]BatchOp[T], []T, error) {
+	staged := make([]BatchOp[T], len(ops))
+	olds := make([]T, len(ops))
+
+	// pending holds the records written by the operations
+	// already staged, nil for those they deleted.
+	pending := map[string]*T{}
+	load := func(i int, id string) (T, error) {
+		if record, ok := pending[id]; ok {
+			if record == nil {
+				var zero T
+				return zero, &NotFoundError{ID: id}
+			}
+			return *record, nil
+		}
+
+		// the first operation on a record of d is made at its version
+		record, version, err := h.loadAt(ctx, id, ops[i].Version)
+		staged[i].Version = version
+		return record, err
+	}
+	written := func(id string, record *T) {
+		if id != "" {
+			pending[id] = record
+		}
+	}
+
+	for i, op := range ops {
+		if err := op.check(); err != nil {
+			return nil, nil, &BatchError{Index: i, Err: &BadRequestError{Err: err}}
+		}
+
+		staged[i] = op
+		if op.Record != nil {
+			record := *op.Record
+			staged[i].Record = &record
+		}
+
+		var err error
+		switch op.Op {
+		case BatchCreate:
+			if err = h.beforeCreate(ctx, staged[i].Record); err == nil {
+				written(h.keyOf(*staged[i].Record), staged[i].Record)
+			}
+		case BatchUpdate:
+			if olds[i], err = load(i, op.ID); err == nil {
+				err = h.beforeUpdate(ctx, op.ID, olds[i], staged[i].Record)
+			}
+			if err == nil {
+				// the update may rename the record
+				id := h.keyOf(*staged[i].Record)
+				if id == "" {
+					id = op.ID
+				}
+				written(op.ID, nil)
+				written(id, staged[i].Record)
+			}
+		case BatchDelete:
+			var stamped *T
+			if olds[i], err = load(i, op.ID); err == nil {
+				stamped, err = h.beforeDelete(ctx, op.ID, olds[i])
+			}
+			if stamped != nil {
+				staged[i] = BatchOp[T]{Op: BatchUpdate, ID: op.ID, Record: stamped, Version: staged[i].Version}
+			}
+			written(op.ID, nil)
+		}
+		if err != nil {
+			return nil, nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	return staged, olds, nil
+}
+
+type hookedVersioned[T any] struct {
+	*hooked[T]
+}
+
+func (h *hookedVersioned[T]) GetVersion(ctx context.Context, id string) (T, uint64, error) {
+	return h.load(ctx, id)
+}
+
+func (h *hookedVersioned[T]) UpdateVersion(ctx context.Context, id string, version uint64, record T) (uint64, error) {
+	return h.UpdateRecord(ctx, id, version, &record)
+}
+
+func (h *hookedVersioned[T]) DeleteVersion(ctx context.Context, id string, version uint64) error {
+	return h.delete(ctx, id, version)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type deletableUser struct {
+	Username  string     `json:"username"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func TestHooks(t *testing.T) {
+	trail := &bytes.Buffer{}
+	key := func(u deletableUser) string { return u.Username }
+
+	users := WithHooks[deletableUser](&SliceDb[deletableUser]{Key: key}, Hooks[deletableUser]{
+		BeforeDelete: func(ctx context.Context, id string, u deletableUser) error {
+			if id == "root" {
+				return errors.New("root stays")
+			}
+			return nil
+		},
+		Audit:      NewAuditLog[deletableUser](trail),
+		Key:        key,
+		SoftDelete: "deleted_at",
+	})
+	if _, ok := users.(Versioned[deletableUser]); !ok {
+		t.Error("hooked SliceDb is not Versioned")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Actor(func(ctx *gin.Context) string { return ctx.GetHeader("X-User") }))
+	RegisterResource(&r.RouterGroup, "/users", users)
+
+	steps := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/users", `{"username":"root"}`, http.StatusCreated},
+		{"POST", "/users", `{"username":"Bob","deleted_at":"2020-01-01T00:00:00Z"}`, http.StatusCreated},
+		{"GET", "/users/Bob", "", http.StatusOK},
+		{"DELETE", "/users/root", "", http.StatusForbidden},
+		{"DELETE", "/users/Bob", "", http.StatusNoContent},
+		{"GET", "/users/Bob", "", http.StatusNotFound},
+		{"GET", "/users/Bob?include_deleted=true", "", http.StatusOK},
+		{"PUT", "/users/Bob", `{"username":"Bob"}`, http.StatusNotFound},
+		{"POST", "/users/batch", `{"operations":[{"op":"delete","id":"root"}]}`, http.StatusForbidden},
+	}
+	for _, s := range steps {
+		if w := do(r, s.method, s.path, s.body, "X-User", "alice"); w.Code != s.status {
+			t.Errorf("%s %s: %d, want %d: %s", s.method, s.path, w.Code, s.status, w.Body)
+		}
+	}
+
+	if w := do(r, "GET", "/users", ""); !strings.Contains(w.Body.String(), "root") || strings.Contains(w.Body.String(), "Bob") {
+		t.Errorf("list: %s", w.Body)
+	}
+	if w := do(r, "GET", "/users?include_deleted=true", ""); !strings.Contains(w.Body.String(), "Bob") {
+		t.Errorf("list with deleted: %s", w.Body)
+	}
+
+	ops := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(trail.String()), "\n") {
+		entry := AuditEntry[deletableUser]{}
+		json.Unmarshal([]byte(line), &entry)
+		ops = append(ops, entry.Actor+" "+entry.Op+" "+entry.ID)
+
+		if entry.Op == ChangeDeleted && (entry.After == nil || entry.After.DeletedAt == nil) {
+			t.Errorf("soft delete not stamped: %s", line)
+		}
+	}
+	if got, want := strings.Join(ops, ", "), "alice created root, alice created Bob, alice deleted Bob"; got != want {
+		t.Errorf("audit trail %q, want %q", got, want)
+	}
+}
+
+func TestHooksBatchSeesPendingWrites(t *testing.T) {
+	trail := &bytes.Buffer{}
+	key := func(u deletableUser) string { return u.Username }
+	store := &SliceDb[deletableUser]{Key: key}
+
+	olds := []string{}
+	users := WithHooks[deletableUser](store, Hooks[deletableUser]{
+		BeforeUpdate: func(ctx context.Context, id string, old deletableUser, u *deletableUser) error {
+			olds = append(olds, id+" was "+old.Username)
+			return nil
+		},
+		Audit:      NewAuditLog[deletableUser](trail),
+		Key:        key,
+		SoftDelete: "deleted_at",
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(&r.RouterGroup, "/users", users)
+
+	w := do(r, "POST", "/users/batch", `{"operations":[
+		{"op":"create","record":{"username":"Bob"}},
+		{"op":"update","id":"Bob","record":{"username":"Robert"}},
+		{"op":"update","id":"Robert","record":{"username":"Robert"}},
+		{"op":"create","record":{"username":"Ann"}},
+		{"op":"delete","id":"Ann"}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+	if got, want := strings.Join(olds, ", "), "Bob was Bob, Robert was Robert"; got != want {
+		t.Errorf("updates saw %q, want %q", got, want)
+	}
+
+	if w := do(r, "GET", "/users/Robert", ""); w.Code != http.StatusOK {
+		t.Errorf("GET Robert: %d", w.Code)
+	}
+	if w := do(r, "GET", "/users/Ann?include_deleted=true", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "deleted_at") {
+		t.Errorf("GET Ann: %d %s", w.Code, w.Body)
+	}
+
+	// Records deleted earlier in the batch are gone for the next operations.
+	for _, op := range []string{
+		`{"op":"update","id":"Robert","record":{"username":"Robert"}}`,
+		`{"op":"delete","id":"Robert"}`,
+	} {
+		w := do(r, "POST", "/users/batch", `{"operations":[{"op":"delete","id":"Robert"},`+op+`]}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s after delete: %d %s", op, w.Code, w.Body)
+		}
+	}
+	if w := do(r, "GET", "/users/Robert", ""); w.Code != http.StatusOK {
+		t.Errorf("failed batches deleted Robert: %d", w.Code)
+	}
+
+	if got := strings.Count(trail.String(), "\n"); got != 5 {
+		t.Errorf("%d audit entries, want 5: %s", got, trail)
+	}
+}
+
+type profile struct {
+	Username  string     `json:"username"`
+	Bio       string     `json:"bio"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func TestHooksUpdateRacingSoftDelete(t *testing.T) {
+	key := func(p profile) string { return p.Username }
+	store := &SliceDb[profile]{Key: key}
+	users := WithHooks[profile](store, Hooks[profile]{Key: key, SoftDelete: "deleted_at"})
+	ctx := context.Background()
+
+	for i := range 200 {
+		id := "user" + strconv.Itoa(i)
+		if err := users.Add(ctx, profile{Username: id}); err != nil {
+			t.Fatal(err)
+		}
+
+		var updated, deleted error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			updated = users.Update(ctx, id, profile{Username: id, Bio: "updated"})
+		}()
+		go func() {
+			defer wg.Done()
+			deleted = users.Delete(ctx, id)
+		}()
+		wg.Wait()
+
+		if deleted != nil {
+			t.Fatalf("%s: delete: %v", id, deleted)
+		}
+		var notFound *NotFoundError
+		if updated != nil && !errors.As(updated, &notFound) {
+			t.Fatalf("%s: update: %v", id, updated)
+		}
+
+		// the delete stays, and keeps the update when it came first
+		stored, err := store.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.DeletedAt == nil {
+			t.Fatalf("%s: the update undid the delete", id)
+		}
+		if (updated == nil) != (stored.Bio == "updated") {
+			t.Fatalf("%s: update returned %v, stored %+v", id, updated, stored)
+		}
+	}
+}
+
+func TestHooksRerunAfterLostWrites(t *testing.T) {
+	key := func(p profile) string { return p.Username }
+	store := &SliceDb[profile]{Key: key, Db: []profile{{Username: "Ann"}, {Username: "Bob"}}}
+	ctx := context.Background()
+
+	var users DAO[profile]
+	olds := []string{}
+	users = WithHooks[profile](store, Hooks[profile]{
+		BeforeUpdate: func(ctx context.Context, id string, old profile, p *profile) error {
+			olds = append(olds, old.Bio)
+			if len(olds) == 1 {
+				// a delete lands between the read and the write
+				if err := users.Delete(ctx, id); err != nil {
+					t.Error(err)
+				}
+			}
+			return nil
+		},
+		BeforeDelete: func(ctx context.Context, id string, old profile) error {
+			olds = append(olds, old.Bio)
+			if id == "Bob" && len(olds) == 3 {
+				// an update lands between the read and the write
+				if err := store.Update(ctx, id, profile{Username: id, Bio: "updated"}); err != nil {
+					t.Error(err)
+				}
+			}
+			return nil
+		},
+		Key:        key,
+		SoftDelete: "deleted_at",
+	})
+
+	var notFound *NotFoundError
+	if err := users.Update(ctx, "Ann", profile{Username: "Ann", Bio: "late"}); !errors.As(err, &notFound) {
+		t.Errorf("update of a deleted record: %v", err)
+	}
+	if ann, _ := store.GetByID(ctx, "Ann"); ann.DeletedAt == nil || ann.Bio != "" {
+		t.Errorf("Ann %+v, want deleted", ann)
+	}
+
+	if err := users.Delete(ctx, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if bob, _ := store.GetByID(ctx, "Bob"); bob.DeletedAt == nil || bob.Bio != "updated" {
+		t.Errorf("Bob %+v, want the update deleted", bob)
+	}
+
+	if got, want := strings.Join(olds, ","), ",,,updated"; got != want {
+		t.Errorf("hooks saw %q, want %q", got, want)
+	}
+
+	if err := users.Add(ctx, profile{Username: "Cid"}); err != nil {
+		t.Fatal(err)
+	}
+	var precondition *PreconditionFailedError
+	if err := users.(Versioned[profile]).DeleteVersion(ctx, "Cid", 99); !errors.As(err, &precondition) {
+		t.Errorf("delete at a stale version: %v", err)
+	}
+}
+
+func TestSoftDeleteFeed(t *testing.T) {
+	changes := NewChangeLog(10, func(u deletableUser) string { return u.Username })
+	users := Observe(WithHooks[deletableUser](&SliceDb[deletableUser]{
+		Key: func(u deletableUser) string { return u.Username },
+		Db:  []deletableUser{{Username: "Ann"}, {Username: "Bob"}},
+	}, Hooks[deletableUser]{SoftDelete: "deleted_at"}), changes)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(&r.RouterGroup, "/users", users)
+
+	_, feed, cancel, _ := changes.Subscribe(0)
+	defer cancel()
+
+	if w := do(r, "DELETE", "/users/Ann", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if w := do(r, "POST", "/users/batch", `{"operations":[{"op":"delete","id":"Bob"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+
+	for _, id := range []string{"Ann", "Bob"} {
+		select {
+		case c := <-feed:
+			if c.Type != ChangeDeleted || c.ID != id {
+				t.Errorf("change %s %s, want deleted %s", c.Type, c.ID, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no change for %s", id)
+		}
+	}
+}
+
+func TestHooksResponsesShowStoredRecords(t *testing.T) {
+	key := func(u deletableUser) string { return u.Username }
+	lower := func(ctx context.Context, u *deletableUser) error {
+		u.Username = strings.ToLower(u.Username)
+		return nil
+	}
+	changes := NewChangeLog(10, key)
+	users := Observe(WithHooks[deletableUser](&SliceDb[deletableUser]{Key: key}, Hooks[deletableUser]{
+		BeforeCreate: lower,
+		BeforeUpdate: func(ctx context.Context, id string, old deletableUser, u *deletableUser) error {
+			return lower(ctx, u)
+		},
+		Key:        key,
+		SoftDelete: "deleted_at",
+	}), changes)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(&r.RouterGroup, "/users", users)
+
+	_, feed, cancel, _ := changes.Subscribe(0)
+	defer cancel()
+
+	w := do(r, "POST", "/users", `{"username":"BOB","deleted_at":"2024-01-01T00:00:00Z"}`)
+	if w.Code != http.StatusCreated || w.Body.String() != `{"username":"bob"}` {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	if location := w.Header().Get("Location"); location != "/users/bob" {
+		t.Errorf("Location %q, want /users/bob", location)
+	}
+	if w := do(r, "GET", w.Header().Get("Location"), ""); w.Code != http.StatusOK {
+		t.Errorf("GET Location: %d", w.Code)
+	}
+
+	if w := do(r, "PUT", "/users/bob", `{"username":"BOB"}`); w.Body.String() != `{"username":"bob"}` {
+		t.Errorf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	w = do(r, "POST", "/users/batch", `{"operations":[{"op":"create","record":{"username":"ANN"}}]}`)
+	if !strings.Contains(w.Body.String(), `"record":{"username":"ann"`) {
+		t.Errorf("batch: %d %s", w.Code, w.Body)
+	}
+
+	for _, want := range []string{"bob", "bob", "ann"} {
+		select {
+		case c := <-feed:
+			if c.ID != want || c.Record.Username != want {
+				t.Errorf("change %s of %+v, want %s", c.ID, c.Record, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no change for %s", want)
+		}
+	}
+}
+
+func TestProxyUser(t *testing.T) {
+	who := ProxyUser("X-Forwarded-User", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Actor(who))
+	r.GET("/", func(ctx *gin.Context) { ctx.String(http.StatusOK, ActorFrom(ctx.Request.Context())) })
+
+	authed := gin.New()
+	authed.Use(gin.BasicAuth(gin.Accounts{"ann": "secret"}), Actor(who))
+	authed.GET("/", func(ctx *gin.Context) { ctx.String(http.StatusOK, ActorFrom(ctx.Request.Context())) })
+
+	cases := []struct {
+		router http.Handler
+		remote string
+		basic  bool
+		want   string
+	}{
+		{r, "10.1.2.3:4000", false, "bob"},
+		{r, "[::ffff:10.1.2.3]:4000", false, "bob"},
+		{r, "192.168.1.1:4000", false, "anonymous"},
+		{authed, "192.168.1.1:4000", true, "ann"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		req.Header.Set("X-Forwarded-User", "bob")
+		if c.basic {
+			req.SetBasicAuth("ann", "secret")
+		}
+		w := httptest.NewRecorder()
+		c.router.ServeHTTP(w, req)
+
+		if w.Body.String() != c.want {
+			t.Errorf("from %s: actor %q, want %q", c.remote, w.Body, c.want)
+		}
+	}
+}
+
+func TestSearchSoftDeleted(t *testing.T) {
+	key := func(u deletableUser) string { return u.Username }
+	users := WithHooks[deletableUser](&SliceDb[deletableUser]{Key: key}, Hooks[deletableUser]{Key: key, SoftDelete: "deleted_at"})
+	for _, name := range []string{"Ann", "Andy", "Bob"} {
+		users.Add(context.Background(), deletableUser{Username: name})
+	}
+	users.Delete(context.Background(), "Ann")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	qf := func(q map[string]string) QueryFunc[deletableUser] {
+		return filterQuery(users, func(u deletableUser) bool { return strings.HasPrefix(u.Username, q["name"]) })
+	}
+	RegisterSearch(&r.RouterGroup, "/users/search", users, qf, nil, IncludeDeleted())
+
+	for query, want := range map[string]string{
+		"name=A":                       "[Andy]",
+		"name=A&include_deleted=true":  "[Ann Andy]",
+		"name=Bo&include_deleted=true": "[Bob]",
+	} {
+		w := do(r, "GET", "/users/search?"+query, "")
+		got := []deletableUser{}
+		json.Unmarshal(w.Body.Bytes(), &got)
+		names := []string{}
+		for _, u := range got {
+			names = append(names, u.Username)
+		}
+		if s := "[" + strings.Join(names, " ") + "]"; s != want {
+			t.Errorf("%s: %d %s, want %s", query, w.Code, s, want)
+		}
+	}
+}
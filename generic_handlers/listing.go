@@ -0,0 +1,437 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxLimit = 1000
+
+// listParams are the query parameters used by the list handlers,
+// the others are left to filters.
+var listParams = []string{"limit", "offset", "cursor", "sort", "fields", "include_deleted"}
+
+type sortKey struct {
+	field structField
+	desc  bool
+}
+
+// listOptions describe the page of records a client asked for:
+//
+//	?limit=20&offset=40      offset pagination
+//	?limit=20&cursor=...     keyset pagination, cursors come from Link headers
+//	?sort=active,-username   ascending active, then descending username
+//	?fields=username,active  only these fields in each record
+//
+// Every record is listed when no limit is given. Records keep the
+// order of the query unless sort or cursor is given.
+type listOptions struct {
+	limit  int // 0 when the client gave none
+	offset int
+	// useCursor is set when the page is sorted or resumes from
+	// a cursor, without an offset. The Link headers then carry
+	// cursors, other pages are cut with offsets.
+	useCursor bool
+	sortParam string
+	sort      []sortKey
+	fields    []string
+	// after is the position the page resumes after, nil
+	// unless the page was requested with a cursor.
+	after *position
+}
+
+// position is the place of a record in a keyset page order: the
+// values of its sort keys, then its ID so that no two records tie.
+type position struct {
+	values []keyValue
+	id     string
+}
+
+// keyValue is the value of a sort key, ok is false when the
+// record has none (nil pointers).
+type keyValue struct {
+	v  reflect.Value
+	ok bool
+}
+
+func positionOf[T any](record T, keys []sortKey, id string) position {
+	v := reflect.ValueOf(record)
+	p := position{values: make([]keyValue, len(keys)), id: id}
+	for i, key := range keys {
+		p.values[i].v, p.values[i].ok = fieldValue(v, key.field)
+	}
+	return p
+}
+
+// comparePositions orders positions by keys, records
+// missing a field come first.
+func comparePositions(a, b position, keys []sortKey) int {
+	for i, key := range keys {
+		va, vb := a.values[i], b.values[i]
+
+		c := 0
+		switch {
+		case va.ok && vb.ok:
+			c = compareValues(va.v, vb.v)
+		case vb.ok:
+			c = -1
+		case va.ok:
+			c = 1
+		}
+
+		if key.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.id, b.id)
+}
+
+// cursor is the content of the opaque cursor parameter, the position
+// of the last record of the previous page. It is bound to the sort
+// order it was issued for.
+type cursor struct {
+	After []json.RawMessage `json:"a,omitempty"`
+	ID    string            `json:"id"`
+	Sort  string            `json:"s,omitempty"`
+}
+
+func encodeCursor(p position, sortParam string) string {
+	c := cursor{ID: p.id, Sort: sortParam}
+	for _, value := range p.values {
+		raw := []byte("null")
+		if value.ok {
+			raw, _ = json.Marshal(exported(value.v).Interface())
+		}
+		c.After = append(c.After, raw)
+	}
+
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor reads the position of s, keys must be
+// the sort order the cursor was issued for.
+func decodeCursor(s string, keys []sortKey) (cursor, *position, error) {
+	c := cursor{}
+	invalid := fmt.Errorf("invalid cursor")
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(raw, &c)
+	}
+	if err != nil {
+		return c, nil, invalid
+	}
+	if len(c.After) != len(keys) {
+		return c, nil, fmt.Errorf("cursor was issued for another sort order")
+	}
+
+	p := &position{values: make([]keyValue, len(keys)), id: c.ID}
+	for i, key := range keys {
+		if string(c.After[i]) == "null" {
+			continue
+		}
+		v := reflect.New(indirect(key.field.Type))
+		if err := json.Unmarshal(c.After[i], v.Interface()); err != nil {
+			return c, nil, invalid
+		}
+		p.values[i] = keyValue{v: v.Elem(), ok: true}
+	}
+
+	return c, p, nil
+}
+
+// parseListOptions reads the list parameters of q for records of type T.
+func parseListOptions[T any](q url.Values) (listOptions, error) {
+	opts := listOptions{}
+	fields := fieldsOf(reflect.TypeFor[T]())
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+		opts.limit = limit
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return opts, fmt.Errorf("offset must be a positive integer")
+		}
+		opts.offset = offset
+	}
+
+	opts.sortParam = q.Get("sort")
+	for _, name := range splitParam(opts.sortParam) {
+		key := sortKey{}
+		if rest, ok := strings.CutPrefix(name, "-"); ok {
+			key.desc = true
+			name = rest
+		}
+
+		f, ok := lookupField(fields, name)
+		if !ok {
+			return opts, fmt.Errorf("cannot sort on unknown field %q", name)
+		}
+		if !f.sortable() {
+			return opts, fmt.Errorf("cannot sort on field %q", f.Name)
+		}
+		key.field = f
+		opts.sort = append(opts.sort, key)
+	}
+	opts.useCursor = len(opts.sort) > 0 && !q.Has("offset")
+
+	if v := q.Get("cursor"); v != "" {
+		c, after, err := decodeCursor(v, opts.sort)
+		if err != nil {
+			return opts, err
+		}
+		if c.Sort != opts.sortParam {
+			return opts, fmt.Errorf("cursor was issued for another sort order")
+		}
+		opts.after = after
+		opts.offset = 0
+		opts.useCursor = true
+	}
+
+	for _, name := range splitParam(q.Get("fields")) {
+		f, ok := lookupField(fields, name)
+		if !ok {
+			return opts, fmt.Errorf("unknown field %q", name)
+		}
+		opts.fields = append(opts.fields, f.Name)
+	}
+
+	return opts, nil
+}
+
+func splitParam(v string) []string {
+	parts := []string{}
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// sortRecords orders records in place, records missing
+// a field (nil pointers) come first.
+func sortRecords[T any](records []T, keys []sortKey) {
+	if len(keys) == 0 {
+		return
+	}
+
+	slices.SortStableFunc(records, func(a, b T) int {
+		return comparePositions(positionOf(a, keys, ""), positionOf(b, keys, ""), keys)
+	})
+}
+
+// project keeps only fields in the JSON form of record.
+func project[T any](record T, fields []string) (map[string]any, error) {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	all := map[string]any{}
+	if err := json.Unmarshal(raw, &all); err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]any, len(fields))
+	for _, name := range fields {
+		if v, ok := all[name]; ok {
+			projected[name] = v
+		}
+	}
+
+	return projected, nil
+}
+
+// paginate sorts records and cuts the requested page out of them.
+// Cursor pages come in keyset order, see position, next is then
+// the position of the last record when more records follow.
+// records is left untouched, queries may return shared slices.
+func paginate[T any](records []T, opts listOptions, key func(T) string) (page []T, next *position) {
+	if !opts.useCursor || (opts.limit == 0 && opts.after == nil) {
+		if len(opts.sort) > 0 {
+			records = slices.Clone(records)
+			sortRecords(records, opts.sort)
+		}
+
+		start := min(opts.offset, len(records))
+		end := len(records)
+		if opts.limit > 0 {
+			end = min(start+opts.limit, len(records))
+		}
+		return records[start:end], nil
+	}
+
+	type entry struct {
+		record T
+		pos    position
+	}
+	entries := make([]entry, len(records))
+	for i, record := range records {
+		entries[i] = entry{record, positionOf(record, opts.sort, key(record))}
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return comparePositions(a.pos, b.pos, opts.sort)
+	})
+
+	start := 0
+	if opts.after != nil {
+		// the first record past the cursor, the records
+		// written since the previous page move nothing
+		start, _ = slices.BinarySearchFunc(entries, *opts.after, func(e entry, after position) int {
+			if comparePositions(e.pos, after, opts.sort) <= 0 {
+				return -1
+			}
+			return 1
+		})
+	}
+	end := len(entries)
+	if opts.limit > 0 {
+		end = min(start+opts.limit, len(entries))
+	}
+
+	page = make([]T, 0, end-start)
+	for _, e := range entries[start:end] {
+		page = append(page, e.record)
+	}
+	if end < len(entries) && end > start {
+		next = &entries[end-1].pos
+	}
+	return page, next
+}
+
+// respondList writes the page of records of d described by opts,
+// with the total count in X-Total-Count and, when a limit is given,
+// the neighbour pages in Link. The format comes from the Accept
+// header, CSV, NDJSON and MessagePack are streamed.
+func respondList[T any](ctx *gin.Context, d DAO[T], records []T, opts listOptions) {
+	mediaType, ok := negotiateFormat(ctx)
+	if !ok {
+		return
+	}
+
+	// Keyset pages break ties on the record IDs, records
+	// without one are paged with offsets instead.
+	if opts.useCursor && !hasKeys(d, records) {
+		if opts.after != nil {
+			respondError(ctx, fmt.Errorf("cursors need records with IDs: %w", errors.ErrUnsupported))
+			return
+		}
+		opts.useCursor = false
+	}
+
+	total := len(records)
+	page, next := paginate(records, opts, func(record T) string {
+		id, _ := recordKey(d, record)
+		return id
+	})
+
+	ctx.Header("X-Total-Count", strconv.Itoa(total))
+	if opts.limit > 0 {
+		ctx.Header("Link", linkHeader(ctx.Request.URL, opts, total, next))
+	}
+
+	if mediaType != mediaJSON {
+		if err := streamRecords(ctx, mediaType, page, opts.fields); err != nil {
+			// The status is already sent, the client
+			// sees a truncated body.
+			ctx.Error(err)
+		}
+		return
+	}
+
+	if len(opts.fields) == 0 {
+		respondCacheable(ctx, page)
+		return
+	}
+
+	projected := make([]map[string]any, 0, len(page))
+	for _, record := range page {
+		p, err := project(record, opts.fields)
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+		projected = append(projected, p)
+	}
+
+	respondCacheable(ctx, projected)
+}
+
+// hasKeys reports whether d knows the ID of every record.
+func hasKeys[T any](d DAO[T], records []T) bool {
+	for _, record := range records {
+		if _, err := recordKey(d, record); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// linkHeader builds the RFC 8288 links to the neighbour pages:
+// first, previous, next and last with offsets, first and next with
+// cursors, which only ever resume after a record.
+func linkHeader(u *url.URL, opts listOptions, total int, next *position) string {
+	link := func(rel string, set func(q url.Values)) string {
+		q := u.Query()
+		q.Del("offset")
+		q.Del("cursor")
+		q.Set("limit", strconv.Itoa(opts.limit))
+		if set != nil {
+			set(q)
+		}
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, q.Encode(), rel)
+	}
+	offset := func(rel string, offset int) string {
+		if offset == 0 {
+			return link(rel, nil)
+		}
+		return link(rel, func(q url.Values) { q.Set("offset", strconv.Itoa(offset)) })
+	}
+
+	links := []string{link("first", nil)}
+
+	if opts.useCursor {
+		if next != nil {
+			links = append(links, link("next", func(q url.Values) {
+				q.Set("cursor", encodeCursor(*next, opts.sortParam))
+			}))
+		}
+		return strings.Join(links, ", ")
+	}
+
+	if opts.offset > 0 {
+		links = append(links, offset("prev", max(opts.offset-opts.limit, 0)))
+	}
+	if opts.offset+opts.limit < total {
+		links = append(links, offset("next", opts.offset+opts.limit))
+	}
+
+	last := 0
+	if total > 0 {
+		last = (total - 1) / opts.limit * opts.limit
+	}
+	links = append(links, offset("last", last))
+
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestListPagination(t *testing.T) {
+	users := &SliceDb[testUser]{
+		Key: func(u testUser) string { return u.Username },
+		Db: []testUser{
+			{Username: "Adam", Active: false},
+			{Username: "Eve", Active: true},
+			{Username: "Bob", Active: true},
+			{Username: "Charlie", Active: false},
+		},
+	}
+	r := newTestRouter(users)
+
+	w := do(r, "GET", "/users?sort=-active,username&limit=3", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "4" {
+		t.Errorf("X-Total-Count %q, want 4", got)
+	}
+
+	page := []testUser{}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	names := []string{}
+	for _, u := range page {
+		names = append(names, u.Username)
+	}
+	if got, want := names, []string{"Bob", "Eve", "Adam"}; !slices.Equal(got, want) {
+		t.Fatalf("first page %v, want %v", got, want)
+	}
+
+	next := regexp.MustCompile(`<([^>]*)>; rel="next"`).FindStringSubmatch(w.Header().Get("Link"))
+	if next == nil {
+		t.Fatalf("no next link in %q", w.Header().Get("Link"))
+	}
+
+	w = do(r, "GET", next[1]+"&fields=username", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("next page: status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Body.String(); got != `[{"username":"Charlie"}]` {
+		t.Errorf("next page %s", got)
+	}
+
+	for _, query := range []string{"limit=0", "sort=nope", "fields=nope", "cursor=bad", "sort=username&" + next[1][len("/users?"):]} {
+		if w := do(r, "GET", "/users?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestListCursorResumesAfterRecord(t *testing.T) {
+	users := &SliceDb[testUser]{Key: func(u testUser) string { return u.Username }}
+	for _, name := range []string{"Adam", "Bob", "Charlie", "Dave", "Eve"} {
+		users.Add(context.Background(), testUser{Username: name, Active: true})
+	}
+	r := newTestRouter(users)
+	nextLink := regexp.MustCompile(`<([^>]*)>; rel="next"`)
+
+	w := do(r, "GET", "/users?sort=-active&limit=2", "")
+	if got := w.Body.String(); got != `[{"username":"Adam","active":true},{"username":"Bob","active":true}]` {
+		t.Fatalf("first page %s", got)
+	}
+	next := nextLink.FindStringSubmatch(w.Header().Get("Link"))
+	if next == nil {
+		t.Fatalf("no next link in %q", w.Header().Get("Link"))
+	}
+
+	// writes before the cursor neither skip nor repeat records
+	users.Delete(context.Background(), "Adam")
+	users.Add(context.Background(), testUser{Username: "Aaron", Active: true})
+
+	names := []string{}
+	for next != nil {
+		w = do(r, "GET", next[1], "")
+		page := []testUser{}
+		json.Unmarshal(w.Body.Bytes(), &page)
+		for _, u := range page {
+			names = append(names, u.Username)
+		}
+		next = nextLink.FindStringSubmatch(w.Header().Get("Link"))
+	}
+	if want := []string{"Charlie", "Dave", "Eve"}; !slices.Equal(names, want) {
+		t.Errorf("following pages %v, want %v", names, want)
+	}
+}
+
+func TestListLimitKeepsOrder(t *testing.T) {
+	users := &SliceDb[testUser]{Key: func(u testUser) string { return u.Username }}
+	for _, name := range []string{"Eve", "Adam", "Charlie", "Bob"} {
+		users.Add(context.Background(), testUser{Username: name})
+	}
+	r := newTestRouter(users)
+
+	all := []testUser{}
+	json.Unmarshal(do(r, "GET", "/users", "").Body.Bytes(), &all)
+
+	w := do(r, "GET", "/users?limit=2", "")
+	page := []testUser{}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if !slices.Equal(page, all[:2]) {
+		t.Errorf("page %v, want the first records %v", page, all[:2])
+	}
+	if want := `</users?limit=2&offset=2>; rel="next"`; !strings.Contains(w.Header().Get("Link"), want) {
+		t.Errorf("Link %q, want %s", w.Header().Get("Link"), want)
+	}
+}
+
+func TestListWithoutLimit(t *testing.T) {
+	users := &SliceDb[testUser]{Key: func(u testUser) string { return u.Username }}
+	for i := range 120 {
+		users.Add(context.Background(), testUser{Username: fmt.Sprintf("user%03d", 119-i)})
+	}
+	r := newTestRouter(users)
+
+	w := do(r, "GET", "/users", "")
+	page := []testUser{}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page) != 120 || page[0].Username != "user119" {
+		t.Errorf("%d records listed, want all 120 in insertion order", len(page))
+	}
+	if link := w.Header().Get("Link"); link != "" {
+		t.Errorf("Link %q without a limit", link)
+	}
+}
+
+func TestLookupFieldCaseInsensitive(t *testing.T) {
+	type clash struct {
+		Lower string `json:"name"`
+		Upper string `json:"NAME"`
+		Mixed string `json:"Name"`
+	}
+	fields := fieldsOf(reflect.TypeFor[clash]())
+
+	for range 20 {
+		f, ok := lookupField(fields, "nAmE")
+		if !ok || f.Name != "NAME" {
+			t.Fatalf("got %q, want NAME", f.Name)
+		}
+	}
+	if f, _ := lookupField(fields, "Name"); f.Name != "Name" {
+		t.Errorf("exact match %q, want Name", f.Name)
+	}
+}
+
+func TestListWithoutIDsUsesOffsets(t *testing.T) {
+	// neither a Key nor Identifiable records
+	users := &SliceDb[testUser]{Db: []testUser{
+		{Username: "Adam", Active: true},
+		{Username: "Bob", Active: true},
+		{Username: "Charlie", Active: true},
+	}}
+	r := newTestRouter(users)
+
+	w := do(r, "GET", "/users?sort=active&limit=2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	next := regexp.MustCompile(`<([^>]*)>; rel="next"`).FindStringSubmatch(w.Header().Get("Link"))
+	if next == nil {
+		t.Fatalf("no next link in %q", w.Header().Get("Link"))
+	}
+	if want := "/users?limit=2&offset=2&sort=active"; next[1] != want {
+		t.Errorf("next link %s, want %s", next[1], want)
+	}
+
+	cursor := encodeCursor(position{values: []keyValue{{}}}, "active")
+	if w := do(r, "GET", "/users?sort=active&limit=2&cursor="+cursor, ""); w.Code != http.StatusNotImplemented {
+		t.Errorf("cursor: status %d, want 501", w.Code)
+	}
+}
+
+type audited struct {
+	Age     int       `json:"age"`
+	Created time.Time `json:"created"`
+}
+
+type member struct {
+	Name string `json:"name"`
+	audited
+}
+
+func TestListPromotedFields(t *testing.T) {
+	members := &SliceDb[member]{
+		Key: func(m member) string { return m.Name },
+		Db: []member{
+			{Name: "Ann", audited: audited{Age: 40}},
+			{Name: "Bob", audited: audited{Age: 20}},
+			{Name: "Cid", audited: audited{Age: 30}},
+		},
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(&r.RouterGroup, "/members", members)
+
+	w := do(r, "GET", "/members?sort=age&limit=2&fields=name", "")
+	if w.Code != http.StatusOK || w.Body.String() != `[{"name":"Bob"},{"name":"Cid"}]` {
+		t.Fatalf("sort by a promoted field: %d %s", w.Code, w.Body)
+	}
+
+	next := regexp.MustCompile(`<([^>]*)>; rel="next"`).FindStringSubmatch(w.Header().Get("Link"))
+	if next == nil {
+		t.Fatalf("no next link in %q", w.Header().Get("Link"))
+	}
+	if w := do(r, "GET", next[1]+"&fields=name", ""); w.Body.String() != `[{"name":"Ann"}]` {
+		t.Errorf("next page: %d %s", w.Code, w.Body)
+	}
+
+	if w := do(r, "GET", "/members?age[gt]=25&sort=name&fields=name", ""); w.Body.String() != `[{"name":"Ann"},{"name":"Cid"}]` {
+		t.Errorf("filter on a promoted field: %d %s", w.Code, w.Body)
+	}
+
+	// times cannot be read through the unexported struct
+	for _, query := range []string{"sort=created", "created[gt]=2020-01-01T00:00:00Z"} {
+		if w := do(r, "GET", "/members?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
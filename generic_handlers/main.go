@@ -1,15 +1,41 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type QueryParamFunc[T any] func(map[string]string) QueryFunc[T]
 
+// RegisterSearch serves GetRecordsFiltered at path, after handlers,
+// and documents it in DefaultSpec. params are the query parameters
+// qf reads.
+func RegisterSearch[T any](group *gin.RouterGroup, path string, d DAO[T], qf QueryParamFunc[T], params []Param, handlers ...gin.HandlerFunc) {
+	group.GET(path, append(handlers, GetRecordsFiltered(d, qf))...)
+	documentList[T](DefaultSpec, strings.TrimSuffix(group.BasePath(), "/")+path, "Search "+typeName(reflect.TypeFor[T]())+" records", params...)
+}
+
+// RegisterList serves GetAllRecords at path, after handlers,
+// and documents it in DefaultSpec.
+func RegisterList[T any](group *gin.RouterGroup, path string, d DAO[T], q QueryFunc[T], handlers ...gin.HandlerFunc) {
+	group.GET(path, append(handlers, GetAllRecords(d, q))...)
+	documentList[T](DefaultSpec, strings.TrimSuffix(group.BasePath(), "/")+path, "List "+typeName(reflect.TypeFor[T]())+" records")
+}
+
 func GetRecordsFiltered[T any](d DAO[T], qf QueryParamFunc[T]) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 
@@ -18,119 +44,225 @@ func GetRecordsFiltered[T any](d DAO[T], qf QueryParamFunc[T]) gin.HandlerFunc {
 		err := ctx.BindQuery(&query)
 
 		if err != nil {
-			ctx.JSON(
-				http.StatusBadRequest,
-				gin.H{"error": err.Error()},
-			)
+			respondError(ctx, &BadRequestError{Err: err})
+			return
+		}
+
+		opts, err := parseListOptions[T](ctx.Request.URL.Query())
+		if err != nil {
+			respondError(ctx, &BadRequestError{Err: err})
 			return
 		}
 
+		for _, param := range listParams {
+			delete(query, param)
+		}
+
 		q := qf(query)
-		results, err := d.Get(q)
+		results, err := d.Get(ctx.Request.Context(), q)
 
 		if err != nil {
-			ctx.JSON(
-				http.StatusInternalServerError,
-				gin.H{"error": err.Error()},
-			)
+			respondError(ctx, err)
 			return
 		}
 
-		ctx.JSON(http.StatusOK, results)
-
+		respondList(ctx, d, results, opts)
 	}
 }
 
 func GetAllRecords[T any](d DAO[T], q QueryFunc[T]) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 
-		results, err := d.Get(q)
+		opts, err := parseListOptions[T](ctx.Request.URL.Query())
+		if err != nil {
+			respondError(ctx, &BadRequestError{Err: err})
+			return
+		}
+
+		results, err := d.Get(ctx.Request.Context(), q)
 
 		if err != nil {
-			ctx.JSON(
-				http.StatusInternalServerError,
-				gin.H{"error": err.Error()},
-			)
+			respondError(ctx, err)
 			return
 		}
 
-		ctx.JSON(http.StatusOK, results)
+		respondList(ctx, d, results, opts)
+	}
+}
+
+// seed adds records to d when it is empty.
+func seed[T any](d DAO[T], records ...T) {
+	existing, err := d.Dump(context.Background())
+	if err != nil || len(existing) > 0 {
+		return
+	}
+
+	for _, record := range records {
+		if err := d.Add(context.Background(), record); err != nil {
+			log.Printf("failed to seed %v: %v", record, err)
+		}
 	}
 }
 
 func main() {
+	dataDir := flag.String("data-dir", "data", "directory of the databases")
+	fsync := flag.String("fsync", "always", "when to fsync writes: always, interval or never")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long in-flight requests may take to finish on shutdown")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated networks of the authenticating proxies whose X-Forwarded-User is trusted")
+	flag.Parse()
+
+	var proxies []netip.Prefix
+	for _, cidr := range strings.Split(*trustedProxies, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		proxy, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Fatalf("invalid -trusted-proxies: %v", err)
+		}
+		proxies = append(proxies, proxy)
+	}
+
+	syncPolicy, ok := map[string]SyncPolicy{
+		"always":   SyncAlways,
+		"interval": SyncInterval,
+		"never":    SyncNever,
+	}[*fsync]
+	if !ok {
+		log.Fatalf("unknown -fsync policy %q", *fsync)
+	}
+
+	// log.Fatal would skip the deferred closes of run
+	if err := run(*dataDir, syncPolicy, proxies, *shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves the API until a signal comes, then closes the databases.
+func run(dataDir string, syncPolicy SyncPolicy, proxies []netip.Prefix, shutdownTimeout time.Duration) error {
 	// Create a Gin router instance
 	r := gin.Default()
 
 	type User struct {
-		Username string
+		Username string `binding:"required,min=3,max=32,regex=^[A-Za-z0-9_]+$"`
 		Active   bool
+		Points   int `binding:"min=0"`
+
+		DeletedAt *time.Time
 	}
 
 	type Service struct {
 		Local bool
-		Name  string
+		Name  string `binding:"required,max=64"`
 	}
 
-	getAllUsers := func(d DAO[User], q QueryFunc[User]) gin.HandlerFunc {
-		return func(ctx *gin.Context) {
+	userKey := func(u User) string { return u.Username }
 
-			results, err := d.Get(q)
+	userDb, err := OpenFileDb(filepath.Join(dataDir, "users"), FileDbOptions[User]{
+		Key:  userKey,
+		Sync: syncPolicy,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open users: %w", err)
+	}
+	defer closeDb("users", userDb)
 
-			if err != nil {
-				ctx.JSON(
-					http.StatusInternalServerError,
-					gin.H{"error": err.Error()},
-				)
-				return
-			}
+	userChanges := NewChangeLog(1000, userKey)
 
-			ctx.JSON(http.StatusOK, results)
-		}
+	// The audit trail stays out of the database
+	// directories, which FileDb owns.
+	if err := os.MkdirAll(filepath.Join(dataDir, "audit"), 0o755); err != nil {
+		return fmt.Errorf("failed to create the audit directory: %w", err)
 	}
-
-	users := SliceDb[User]{
-		Db: []User{
-			{Username: "Adam", Active: false},
-			{Username: "Eve", Active: true},
-			{Username: "Bob", Active: true},
-			{Username: "Charlie", Active: false},
-		},
+	audit, err := os.OpenFile(filepath.Join(dataDir, "audit", "users.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit trail: %w", err)
 	}
-
-	services := SliceDb[Service]{
-		Db: []Service{
-			{Local: true, Name: "nginx"},
-		},
+	defer audit.Close()
+
+	// Observed last, the feed shows soft deletes as deletes.
+	users := Observe(WithHooks[User](userDb, Hooks[User]{
+		Audit:      NewAuditLog[User](audit),
+		Key:        userKey,
+		SoftDelete: "DeletedAt",
+	}), userChanges)
+
+	services, err := OpenFileDb(filepath.Join(dataDir, "services"), FileDbOptions[Service]{
+		Key:  func(s Service) string { return s.Name },
+		Sync: syncPolicy,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open services: %w", err)
 	}
+	defer closeDb("services", services)
+
+	seed[User](userDb,
+		User{Username: "Adam", Active: false, Points: 40},
+		User{Username: "Eve", Active: true, Points: 250},
+		User{Username: "Bob", Active: true, Points: 120},
+		User{Username: "Charlie", Active: false, Points: 90},
+	)
+	seed[Service](services, Service{Local: true, Name: "nginx"})
+
+	// The authenticating proxy in front tells who makes the request.
+	r.Use(Actor(ProxyUser("X-Forwarded-User", proxies)))
 
 	// Define a simple GET route
-	r.GET("/users_static", getAllUsers(&users, users.Dump))
-	r.GET("/users", GetAllRecords(&users, users.Dump))
+	RegisterList(&r.RouterGroup, "/users_static", users, users.Dump)
+
+	api := r.Group("", Timeout(5*time.Second))
+	RegisterResource(api, "/users", users)
+	RegisterChanges(&r.RouterGroup, "/users/changes", userChanges)
 
-	r.GET("/services", GetAllRecords(&services, services.Dump))
+	RegisterResource(api, "/services", services)
+
+	DefaultSpec.Serve(&r.RouterGroup)
 
 	qf := func(q map[string]string) QueryFunc[User] {
-		return func() ([]User, error) {
-			result := []User{}
+		return filterQuery[User](users, func(u User) bool {
+			return strings.Contains(u.Username, q["name"])
+		})
+	}
 
-			for _, u := range users.Db {
+	RegisterSearch(&r.RouterGroup, "/users/search", users, qf, []Param{
+		{Name: "name", In: "query", Type: reflect.TypeFor[string](), Description: "Part of the username"},
+		includeDeletedParam,
+	}, Timeout(time.Second), IncludeDeleted())
 
-				if strings.Contains(u.Username, q["name"]) {
-					result = append(result, u)
-				}
-			}
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	// Change streams never end on their own.
+	srv.RegisterOnShutdown(userChanges.Close)
 
-			return result, nil
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() {
+		log.Println("Listenning on port 8080")
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("failed to serve: %w", err)
+	case <-ctx.Done():
 	}
 
-	r.GET("/users/search", GetRecordsFiltered(
-		&users,
-		qf,
-	))
+	// Let the requests in flight finish, the
+	// deferred calls then close the databases.
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("failed to drain requests: %v", err)
+	}
+	return nil
+}
 
-	log.Println("Listenning on port 8080")
-	// Start the server on port 8080
-	r.Run(":8080") // Default listens on 0.0.0.0:8080
+// closeDb closes the database name, reporting a failed final sync.
+func closeDb[T any](name string, db *FileDb[T]) {
+	if err := db.Close(); err != nil {
+		log.Printf("failed to close %s: %v", name, err)
+	}
 }
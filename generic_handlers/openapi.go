@@ -0,0 +1,559 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// Operation documents one route of the API.
+type Operation struct {
+	Method    string
+	Path      string // gin syntax, like /users/:id
+	Summary   string
+	Tag       string
+	Params    []Param
+	Body      reflect.Type
+	Responses []Response
+	// PartialBody documents Body with no required field,
+	// for the bodies merged into a stored record.
+	PartialBody bool
+}
+
+// Param is a path or query parameter of an operation.
+type Param struct {
+	Name        string
+	In          string // path, query or header
+	Description string
+	Type        reflect.Type
+	Required    bool
+}
+
+// Response is one of the possible responses of an operation,
+// Type is nil when it has no body.
+type Response struct {
+	Status      int
+	Description string
+	Type        reflect.Type
+	Headers     map[string]string
+	// MediaTypes of the body, application/json when empty.
+	MediaTypes []string
+}
+
+// Spec collects the documented operations and builds
+// the OpenAPI 3.1 document describing them.
+type Spec struct {
+	Title   string
+	Version string
+
+	mu  sync.Mutex
+	ops map[string]Operation
+}
+
+// DefaultSpec documents the routes wired by RegisterResource.
+var DefaultSpec = &Spec{Title: "Generic handlers", Version: "1.0.0"}
+
+// Add documents op, replacing the operation on the same route.
+func (s *Spec) Add(op Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ops == nil {
+		s.ops = map[string]Operation{}
+	}
+	s.ops[op.Method+" "+op.Path] = op
+}
+
+// pathParam matches the parameters of a gin path.
+var pathParam = regexp.MustCompile(`/[:*]([A-Za-z0-9_]+)`)
+
+// Document returns the OpenAPI document, ready to be marshalled to JSON.
+func (s *Spec) Document() map[string]any {
+	s.mu.Lock()
+	ops := make([]Operation, 0, len(s.ops))
+	for _, op := range s.ops {
+		ops = append(ops, op)
+	}
+	s.mu.Unlock()
+
+	b := &schemaBuilder{components: map[string]any{}}
+	paths := map[string]any{}
+
+	for _, op := range ops {
+		path := pathParam.ReplaceAllString(op.Path, "/{$1}")
+
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[path] = item
+		}
+
+		o := map[string]any{
+			"operationId": operationID(op),
+			"summary":     op.Summary,
+		}
+		if op.Tag != "" {
+			o["tags"] = []string{op.Tag}
+		}
+
+		params := []any{}
+		for _, p := range op.Params {
+			param := map[string]any{
+				"name":     p.Name,
+				"in":       p.In,
+				"required": p.Required || p.In == "path",
+				"schema":   b.schema(p.Type),
+			}
+			if p.Description != "" {
+				param["description"] = p.Description
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+
+		if op.Body != nil {
+			body := b
+			if op.PartialBody {
+				body = &schemaBuilder{components: b.components, partial: true}
+			}
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content":  body.content(op.Body),
+			}
+		}
+
+		responses := map[string]any{}
+		for _, r := range op.Responses {
+			res := map[string]any{"description": r.Description}
+			if r.Type != nil {
+				res["content"] = b.content(r.Type, r.MediaTypes...)
+			}
+			if len(r.Headers) > 0 {
+				headers := map[string]any{}
+				for name, desc := range r.Headers {
+					headers[name] = map[string]any{
+						"description": desc,
+						"schema":      map[string]any{"type": "string"},
+					}
+				}
+				res["headers"] = headers
+			}
+			responses[strconv.Itoa(r.Status)] = res
+		}
+		o["responses"] = responses
+
+		item[strings.ToLower(op.Method)] = o
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   s.Title,
+			"version": s.Version,
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": b.components},
+	}
+}
+
+//go:embed docs.html
+var docsPage []byte
+
+// docsAssets are the Swagger UI files docs.html loads, they come
+// from github.com/swaggo/files/v2 and are pinned by go.sum.
+var docsAssets = []string{"swagger-ui.css", "swagger-ui-bundle.js"}
+
+// Serve exposes the document at /openapi.json
+// and a docs UI reading it at /docs.
+func (s *Spec) Serve(group *gin.RouterGroup) {
+	group.GET("/openapi.json", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.Document())
+	})
+	group.GET("/docs", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "text/html; charset=utf-8", docsPage)
+	})
+	for _, name := range docsAssets {
+		group.StaticFileFS("/docs/"+name, name, http.FS(swaggerFiles.FS))
+	}
+}
+
+func operationID(op Operation) string {
+	id := strings.ToLower(op.Method)
+	parts := strings.FieldsFunc(op.Path, func(r rune) bool {
+		return r == '/' || r == ':' || r == '*'
+	})
+	for _, part := range parts {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// documentResource describes the routes wired by RegisterResource.
+func documentResource[T any](spec *Spec, path string) {
+	t := reflect.TypeFor[T]()
+	name := typeName(t)
+	tag := strings.Trim(path, "/")
+
+	str := reflect.TypeFor[string]()
+	id := Param{Name: "id", In: "path", Type: str}
+	ifMatch := Param{Name: "If-Match", In: "header", Type: str, Description: "ETag the record must still have, 412 otherwise"}
+	etag := map[string]string{"ETag": "Entity tag of the record"}
+
+	spec.Add(listOperation(t, path, "List "+name+" records", tag, append(filterParamDocs(t), includeDeletedParam)...))
+
+	spec.Add(Operation{
+		Method:    http.MethodGet,
+		Path:      path + "/:id",
+		Summary:   "Get a " + name,
+		Tag:       tag,
+		Params:    []Param{id, ifNoneMatchParam, includeDeletedParam},
+		Responses: append([]Response{{Status: http.StatusOK, Description: "The record", Type: t, Headers: etag}, notModifiedResponse}, problems(http.StatusNotFound)...),
+	})
+
+	spec.Add(Operation{
+		Method:    http.MethodPost,
+		Path:      path,
+		Summary:   "Create a " + name,
+		Tag:       tag,
+		Body:      t,
+		Responses: append([]Response{{Status: http.StatusCreated, Description: "The created record", Type: t, Headers: map[string]string{"Location": "URL of the created record"}}}, problems(http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity)...),
+	})
+
+	spec.Add(Operation{
+		Method:    http.MethodPut,
+		Path:      path + "/:id",
+		Summary:   "Replace a " + name,
+		Tag:       tag,
+		Params:    []Param{id, ifMatch},
+		Body:      t,
+		Responses: append([]Response{{Status: http.StatusOK, Description: "The updated record", Type: t, Headers: etag}}, problems(http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusUnprocessableEntity)...),
+	})
+
+	spec.Add(Operation{
+		Method:      http.MethodPatch,
+		Path:        path + "/:id",
+		Summary:     "Update some fields of a " + name,
+		Tag:         tag,
+		Params:      []Param{id, ifMatch},
+		Body:        t,
+		PartialBody: true,
+		Responses:   append([]Response{{Status: http.StatusOK, Description: "The updated record", Type: t, Headers: etag}}, problems(http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusUnprocessableEntity)...),
+	})
+
+	spec.Add(Operation{
+		Method:    http.MethodDelete,
+		Path:      path + "/:id",
+		Summary:   "Delete a " + name,
+		Tag:       tag,
+		Params:    []Param{id, ifMatch},
+		Responses: append([]Response{{Status: http.StatusNoContent, Description: "The record was deleted"}}, problems(http.StatusNotFound, http.StatusPreconditionFailed)...),
+	})
+
+	batch := reflect.TypeFor[BatchResponse[T]]()
+	spec.Add(Operation{
+		Method:  http.MethodPost,
+		Path:    path + "/batch",
+		Summary: "Create, update and delete " + name + " records at once",
+		Tag:     tag,
+		Body:    reflect.TypeFor[BatchRequest[T]](),
+		Responses: append([]Response{
+			{Status: http.StatusOK, Description: "Every operation was applied", Type: batch},
+			{Status: http.StatusNotFound, Description: "Nothing was applied, an operation names a missing record", Type: batch},
+			{Status: http.StatusConflict, Description: "Nothing was applied, an operation conflicts with a record", Type: batch},
+			{Status: http.StatusUnprocessableEntity, Description: "Nothing was applied, operations are invalid", Type: batch},
+		}, problems(http.StatusBadRequest, http.StatusNotImplemented)...),
+	})
+}
+
+// documentList describes a route listing the records of type T with
+// respondList, params come on top of the page parameters.
+func documentList[T any](spec *Spec, path, summary string, params ...Param) {
+	tag, _, _ := strings.Cut(strings.Trim(path, "/"), "/")
+	spec.Add(listOperation(reflect.TypeFor[T](), path, summary, tag, params...))
+}
+
+var (
+	ifNoneMatchParam    = Param{Name: "If-None-Match", In: "header", Type: reflect.TypeFor[string](), Description: "ETag of the cached copy, 304 when it is current"}
+	includeDeletedParam = Param{Name: "include_deleted", In: "query", Type: reflect.TypeFor[bool](), Description: "Include the soft deleted records"}
+	notModifiedResponse = Response{Status: http.StatusNotModified, Description: "The cached copy is current"}
+)
+
+// problems documents the problem responses of statuses.
+func problems(statuses ...int) []Response {
+	res := []Response{}
+	for _, status := range statuses {
+		res = append(res, Response{Status: status, Description: http.StatusText(status), Type: reflect.TypeFor[Problem]()})
+	}
+	return res
+}
+
+// listOperation describes a route listing records of type t with
+// respondList, params come on top of the page parameters.
+func listOperation(t reflect.Type, path, summary, tag string, params ...Param) Operation {
+	return Operation{
+		Method:  http.MethodGet,
+		Path:    path,
+		Summary: summary,
+		Tag:     tag,
+		Params:  append(append(pageParamDocs(), params...), ifNoneMatchParam),
+		Responses: append([]Response{{
+			Status:      http.StatusOK,
+			Description: "A page of records",
+			Type:        reflect.SliceOf(t),
+			Headers: map[string]string{
+				"X-Total-Count": "Number of records matching the filters",
+				"Link":          "Links to the first and next pages, and with offsets to the previous and last pages",
+				"ETag":          "Entity tag of the page",
+			},
+			MediaTypes: mediaTypes,
+		}, notModifiedResponse}, problems(http.StatusBadRequest)...),
+	}
+}
+
+// pageParamDocs documents the list parameters, see listOptions.
+func pageParamDocs() []Param {
+	str, integer := reflect.TypeFor[string](), reflect.TypeFor[int]()
+
+	return []Param{
+		{Name: "limit", In: "query", Type: integer, Description: fmt.Sprintf("Page size, at most %d, every record is listed when absent", maxLimit)},
+		{Name: "offset", In: "query", Type: integer, Description: "Number of records to skip"},
+		{Name: "cursor", In: "query", Type: str, Description: "Opaque cursor taken from a Link header, the page resumes after the record it points to"},
+		{Name: "sort", In: "query", Type: str, Description: "Comma separated fields, descending when prefixed by -"},
+		{Name: "fields", In: "query", Type: str, Description: "Comma separated fields to include in each record"},
+	}
+}
+
+// filterParamDocs documents the equality filters
+// FilterRecords takes on the fields of t.
+func filterParamDocs(t reflect.Type) []Param {
+	params := []Param{}
+
+	fields := fieldsOf(t)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		f := fields[name]
+		if !f.filterable() {
+			continue
+		}
+		params = append(params, Param{
+			Name:        name,
+			In:          "query",
+			Type:        f.Type,
+			Description: "Filter on " + name + ", other operators are written " + name + "[op] with op one of eq, ne, gt, gte, lt, lte, in, contains, prefix, suffix",
+		})
+	}
+
+	return params
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// typeName is the name of t in the components of the document.
+func typeName(t reflect.Type) string {
+	t = indirect(t)
+
+	name := t.Name()
+	if name == "" {
+		return t.Kind().String()
+	}
+
+	// Instantiated generic types are named like Page[main.User].
+	return strings.NewReplacer("[", "_", "]", "", ",", "_", ".", "_", "*", "").Replace(name)
+}
+
+// schemaBuilder converts Go types to JSON schemas, structs
+// are added to components and referenced.
+type schemaBuilder struct {
+	components map[string]any
+	// partial drops the required fields of the structs and of
+	// the structs they hold, which are merged rather than
+	// replaced. Those are named <Type>Patch.
+	partial bool
+}
+
+// whole returns b without partial, JSON replaces the
+// elements of slices and maps along with their fields.
+func (b *schemaBuilder) whole() *schemaBuilder {
+	if !b.partial {
+		return b
+	}
+	return &schemaBuilder{components: b.components}
+}
+
+func (b *schemaBuilder) content(t reflect.Type, mediaTypes ...string) map[string]any {
+	if len(mediaTypes) == 0 {
+		mediaTypes = []string{mediaJSON}
+		if t == reflect.TypeFor[Problem]() {
+			mediaTypes = []string{"application/problem+json"}
+		}
+	}
+
+	s := b.schema(t)
+	content := map[string]any{}
+	for _, mediaType := range mediaTypes {
+		content[mediaType] = map[string]any{"schema": s}
+	}
+	return content
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	nullable := false
+	if t.Kind() == reflect.Pointer {
+		nullable = true
+		t = indirect(t)
+	}
+
+	s := b.typeSchema(t)
+	if nullable {
+		if typ, ok := s["type"].(string); ok {
+			s["type"] = []string{typ, "null"}
+		}
+	}
+
+	return s
+}
+
+func (b *schemaBuilder) typeSchema(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32:
+		return map[string]any{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": b.whole().schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.whole().schema(t.Elem())}
+	case reflect.Struct:
+		name := typeName(t)
+		if b.partial {
+			name += "Patch"
+		}
+		if _, ok := b.components[name]; !ok {
+			// Reserve the name first, t may refer to itself.
+			b.components[name] = map[string]any{}
+			b.components[name] = b.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+
+	return map[string]any{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+
+	fields := fieldsOf(t)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		f := t.FieldByIndex(fields[name].Index)
+
+		s := b.schema(f.Type)
+		if applyRules(s, indirect(f.Type), f.Tag.Get("binding")) && !b.partial {
+			required = append(required, name)
+		}
+		properties[name] = s
+	}
+
+	s := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+
+	return s
+}
+
+// applyRules adds the binding rules of a field to its schema,
+// it reports whether the field is required.
+func applyRules(s map[string]any, t reflect.Type, rules string) bool {
+	required := false
+
+	minKey, maxKey := "minimum", "maximum"
+	switch t.Kind() {
+	case reflect.String:
+		minKey, maxKey = "minLength", "maxLength"
+	case reflect.Slice, reflect.Array:
+		minKey, maxKey = "minItems", "maxItems"
+	case reflect.Map:
+		minKey, maxKey = "minProperties", "maxProperties"
+	}
+
+	number := func(p string) any {
+		if n, err := strconv.ParseFloat(p, 64); err == nil {
+			return n
+		}
+		return p
+	}
+
+	for _, rule := range strings.Split(rules, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "required":
+			required = true
+		case "min", "gte":
+			s[minKey] = number(param)
+		case "max", "lte":
+			s[maxKey] = number(param)
+		case "len":
+			s[minKey], s[maxKey] = number(param), number(param)
+		case "regex":
+			s["pattern"] = strings.NewReplacer("0x2C", ",", "0x7C", "|").Replace(param)
+		case "enum", "oneof":
+			values := []any{}
+			for _, v := range strings.Fields(param) {
+				if t.Kind() == reflect.String {
+					values = append(values, v)
+				} else {
+					values = append(values, number(v))
+				}
+			}
+			s["enum"] = values
+		}
+	}
+
+	return required
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api := r.Group("/api")
+	accounts := &SliceDb[account]{Key: func(a account) string { return a.Name }}
+	RegisterResource(api, "/accounts", accounts)
+	RegisterList(api, "/accounts_all", accounts, accounts.Dump)
+	RegisterSearch(api, "/accounts/search", accounts, func(map[string]string) QueryFunc[account] { return accounts.Dump }, []Param{
+		{Name: "name", In: "query", Type: reflect.TypeFor[string]()},
+	})
+	DefaultSpec.Serve(api)
+
+	w := do(r, "GET", "/api/openapi.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	doc := struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Parameters  []struct{ Name string } `json:"parameters"`
+			RequestBody struct {
+				Content map[string]struct {
+					Schema struct {
+						Ref string `json:"$ref"`
+					} `json:"schema"`
+				} `json:"content"`
+			} `json:"requestBody"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Required   []string                  `json:"required"`
+				Properties map[string]map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != "3.1.0" {
+		t.Errorf("openapi %q", doc.OpenAPI)
+	}
+	for path, methods := range map[string][]string{
+		"/api/accounts":        {"get", "post"},
+		"/api/accounts/{id}":   {"get", "put", "patch", "delete"},
+		"/api/accounts_all":    {"get"},
+		"/api/accounts/search": {"get"},
+	} {
+		for _, m := range methods {
+			if _, ok := doc.Paths[path][m]; !ok {
+				t.Errorf("%s %s is not documented", m, path)
+			}
+		}
+	}
+
+	s, ok := doc.Components.Schemas["account"]
+	if !ok {
+		t.Fatalf("no account schema in %v", doc.Components.Schemas)
+	}
+	if len(s.Required) != 2 {
+		t.Errorf("required %v, want name and role", s.Required)
+	}
+	if s.Properties["role"]["enum"] == nil || s.Properties["name"]["pattern"] != "^[a-z]+$" || s.Properties["quota"]["maximum"] != 100.0 {
+		t.Errorf("rules missing from %v", s.Properties)
+	}
+	if _, ok := doc.Components.Schemas["Problem"]; !ok {
+		t.Error("no Problem schema")
+	}
+
+	// PATCH bodies leave out the fields they keep.
+	patch := doc.Paths["/api/accounts/{id}"]["patch"].RequestBody.Content["application/json"].Schema.Ref
+	if patch != "#/components/schemas/accountPatch" {
+		t.Fatalf("PATCH body %q, want accountPatch", patch)
+	}
+	if p := doc.Components.Schemas["accountPatch"]; len(p.Required) != 0 || p.Properties["name"]["pattern"] != "^[a-z]+$" {
+		t.Errorf("accountPatch requires %v, properties %v", p.Required, p.Properties)
+	}
+
+	search := []string{}
+	for _, p := range doc.Paths["/api/accounts/search"]["get"].Parameters {
+		search = append(search, p.Name)
+	}
+	if !slices.Contains(search, "name") || !slices.Contains(search, "limit") || slices.Contains(search, "role") {
+		t.Errorf("search parameters %v, want name and the page ones", search)
+	}
+
+	for _, path := range []string{"/api/docs", "/api/docs/swagger-ui.css", "/api/docs/swagger-ui-bundle.js"} {
+		if w := do(r, "GET", path, ""); w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", path, w.Code)
+		}
+	}
+}
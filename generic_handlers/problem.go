@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Problem is an RFC 7807 problem details document,
+// all handler errors are sent as application/problem+json.
+type Problem struct {
+	Type     string       `json:"type,omitempty"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError explains why one field of a request was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule,omitempty"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// BadRequestError is returned for malformed requests,
+// like invalid JSON or unknown query parameters.
+type BadRequestError struct {
+	Err error
+}
+
+func (e *BadRequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BadRequestError) Unwrap() error {
+	return e.Err
+}
+
+// statusClientClosedRequest is the nginx status for
+// requests cancelled by the client.
+const statusClientClosedRequest = 499
+
+// respondProblem writes p, its title defaults to the status text.
+func respondProblem(ctx *gin.Context, p Problem) {
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Instance == "" {
+		p.Instance = ctx.Request.URL.Path
+	}
+
+	ctx.Header("Content-Type", "application/problem+json")
+	ctx.JSON(p.Status, p)
+}
+
+// respondError maps handler and DAO errors to a problem. Errors
+// without a problem of their own are logged, their text stays out
+// of the response.
+func respondError(ctx *gin.Context, err error) {
+	p := problemFor(err)
+	if p.Status == http.StatusInternalServerError {
+		log.Printf("%s %s: %v", ctx.Request.Method, ctx.Request.URL.Path, err)
+	}
+	respondProblem(ctx, p)
+}
+
+// problemFor describes err, its status defaults to 500.
+func problemFor(err error) Problem {
+	var notFound *NotFoundError
+	var conflict *ConflictError
+	var precondition *PreconditionFailedError
+	var badRequest *BadRequestError
+	var invalid validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	var veto *VetoError
+
+	p := Problem{Status: http.StatusInternalServerError}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		p.Status = http.StatusGatewayTimeout
+		p.Detail = "the request took too long"
+	case errors.Is(err, context.Canceled):
+		// Nobody reads the response, the status shows up in logs.
+		p.Status = statusClientClosedRequest
+		p.Title = "Client Closed Request"
+	case errors.As(err, &notFound):
+		p.Status = http.StatusNotFound
+		p.Detail = err.Error()
+	case errors.As(err, &conflict):
+		p.Status = http.StatusConflict
+		p.Detail = err.Error()
+	case errors.As(err, &precondition):
+		p.Status = http.StatusPreconditionFailed
+		p.Detail = "the record changed, fetch it again to get its current ETag"
+	case errors.As(err, &invalid):
+		p.Status = http.StatusUnprocessableEntity
+		p.Detail = "the request body failed validation"
+		for _, fe := range invalid {
+			p.Errors = append(p.Errors, fieldError(fe))
+		}
+	case errors.As(err, &typeErr):
+		p.Status = http.StatusBadRequest
+		p.Detail = "the request body has a field of the wrong type"
+		p.Errors = []FieldError{{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("must be %s, not %s", typeErr.Type, typeErr.Value),
+		}}
+	case errors.As(err, &badRequest):
+		p.Status = http.StatusBadRequest
+		p.Detail = err.Error()
+	case errors.As(err, &veto):
+		p.Status = http.StatusForbidden
+		p.Detail = veto.Err.Error()
+	case errors.Is(err, errors.ErrUnsupported):
+		p.Status = http.StatusNotImplemented
+		p.Detail = err.Error()
+	default:
+		p.Detail = "the server failed to handle the request"
+	}
+
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	return p
+}
+
+// fieldError describes a failed validation rule.
+func fieldError(fe validator.FieldError) FieldError {
+	// The namespace starts with the name of the type,
+	// clients only know the path from the body root.
+	_, field, _ := strings.Cut(fe.Namespace(), ".")
+
+	e := FieldError{Field: field, Rule: fe.Tag(), Param: fe.Param()}
+
+	unit := ""
+	switch fe.Kind() {
+	case reflect.String:
+		unit = " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		unit = " items"
+	}
+
+	switch fe.Tag() {
+	case "required":
+		e.Message = "is required"
+	case "min", "gte":
+		e.Message = fmt.Sprintf("must be at least %s%s", fe.Param(), unit)
+	case "max", "lte":
+		e.Message = fmt.Sprintf("must be at most %s%s", fe.Param(), unit)
+	case "len":
+		e.Message = fmt.Sprintf("must be exactly %s%s", fe.Param(), unit)
+	case "regex":
+		e.Message = fmt.Sprintf("must match %s", fe.Param())
+	case "enum", "oneof":
+		e.Message = fmt.Sprintf("must be one of %s", strings.Join(strings.Fields(fe.Param()), ", "))
+	default:
+		e.Message = fmt.Sprintf("failed the %s rule", fe.Tag())
+	}
+
+	return e
+}
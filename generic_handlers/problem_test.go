@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type account struct {
+	Name  string `json:"name" binding:"required,min=3,regex=^[a-z]+$"`
+	Role  string `json:"role" binding:"required,enum=admin user"`
+	Quota int    `json:"quota" binding:"max=100"`
+}
+
+func TestValidationProblems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(&r.RouterGroup, "/accounts", &SliceDb[account]{
+		Key: func(a account) string { return a.Name },
+		Db:  []account{{Name: "root", Role: "admin"}},
+	})
+
+	cases := []struct {
+		method, path, body string
+		status             int
+		fields             []string
+	}{
+		{"POST", "/accounts", `{"name":"bob","role":"user","quota":10}`, http.StatusCreated, nil},
+		{"POST", "/accounts", `{"name":"Al","role":"owner","quota":500}`, http.StatusUnprocessableEntity, []string{"name", "role", "quota"}},
+		{"POST", "/accounts", `{"name":"bob","role":`, http.StatusBadRequest, nil},
+		{"POST", "/accounts", `{"name":1}`, http.StatusBadRequest, []string{"name"}},
+		{"PATCH", "/accounts/root", `{"role":"guest"}`, http.StatusUnprocessableEntity, []string{"role"}},
+		{"GET", "/accounts/nobody", "", http.StatusNotFound, nil},
+		{"GET", "/accounts?limit=x", "", http.StatusBadRequest, nil},
+	}
+
+	for _, c := range cases {
+		w := do(r, c.method, c.path, c.body)
+		if w.Code != c.status {
+			t.Fatalf("%s %s: status %d, want %d: %s", c.method, c.path, w.Code, c.status, w.Body)
+		}
+		if w.Code < 400 {
+			continue
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s %s: content type %q", c.method, c.path, ct)
+		}
+
+		p := Problem{}
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != c.status || p.Title == "" {
+			t.Errorf("%s %s: problem %+v", c.method, c.path, p)
+		}
+
+		fields := []string{}
+		for _, e := range p.Errors {
+			fields = append(fields, e.Field)
+		}
+		if len(fields) != len(c.fields) {
+			t.Errorf("%s %s: field errors %+v, want fields %v", c.method, c.path, p.Errors, c.fields)
+		}
+	}
+}
+
+func TestMalformedRegexTag(t *testing.T) {
+	type broken struct {
+		Name string `json:"name" binding:"regex=^[a-z"`
+	}
+
+	gin.SetMode(gin.TestMode)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("RegisterResource accepted a malformed regex")
+			}
+		}()
+		RegisterResource(&gin.New().RouterGroup, "/broken", &SliceDb[broken]{})
+	}()
+
+	// Handlers wired without RegisterResource fail the field.
+	r := gin.New()
+	r.POST("/broken", CreateRecord[broken](&SliceDb[broken]{Key: func(b broken) string { return b.Name }}))
+	if w := do(r, "POST", "/broken", `{"name":"a"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want 422: %s", w.Code, w.Body)
+	}
+}
+
+func TestRegexTagEscapes(t *testing.T) {
+	type choice struct {
+		Name string `json:"name" binding:"regex=^(a0x7Cb)0x2C?$"`
+	}
+	if err := checkRegexTags(reflect.TypeFor[choice]()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := regexps.Load("^(a|b),?$"); !ok {
+		t.Fatal("the decoded expression is not cached")
+	}
+	cached := 0
+	regexps.Range(func(_, _ any) bool { cached++; return true })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(&r.RouterGroup, "/choices", &SliceDb[choice]{Key: func(c choice) string { return c.Name }})
+
+	for body, status := range map[string]int{
+		`{"name":"a"}`:  http.StatusCreated,
+		`{"name":"b,"}`: http.StatusCreated,
+		`{"name":"c"}`:  http.StatusUnprocessableEntity,
+	} {
+		if w := do(r, "POST", "/choices", body); w.Code != status {
+			t.Errorf("%s: status %d, want %d: %s", body, w.Code, status, w.Body)
+		}
+	}
+
+	// validations use the expression compiled at registration
+	after := 0
+	regexps.Range(func(_, _ any) bool { after++; return true })
+	if after != cached {
+		t.Errorf("%d expressions cached after validating, want %d", after, cached)
+	}
+}
+
+func TestInternalErrorDetail(t *testing.T) {
+	p := problemFor(errors.New("open /var/lib/users.db: permission denied"))
+	if p.Status != http.StatusInternalServerError || strings.Contains(p.Detail, "users.db") {
+		t.Errorf("problem %+v leaks the error", p)
+	}
+}
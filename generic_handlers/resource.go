@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// RegisterResource wires the CRUD routes of dao under path:
+//
+//	GET    path        list records, see FilterRecords
+//	GET    path/:id    get one record
+//	POST   path        create a record
+//	PUT    path/:id    replace a record
+//	PATCH  path/:id    update some fields of a record
+//	DELETE path/:id    delete a record
+//	POST   path/batch  create, update and delete records at once, see BatchRecords
+//
+// The GET routes take ?include_deleted=true, see Hooks.SoftDelete.
+// The routes are documented in DefaultSpec. RegisterResource panics
+// when a regex binding tag of T does not compile.
+func RegisterResource[T any](group *gin.RouterGroup, path string, dao DAO[T]) {
+	if err := checkRegexTags(reflect.TypeFor[T]()); err != nil {
+		panic("RegisterResource: " + err.Error())
+	}
+
+	group.GET(path, IncludeDeleted(), FilterRecords(dao))
+	group.GET(path+"/:id", IncludeDeleted(), GetRecord(dao))
+	group.POST(path, CreateRecord(dao))
+	group.PUT(path+"/:id", ReplaceRecord(dao))
+	group.PATCH(path+"/:id", PatchRecord(dao))
+	group.DELETE(path+"/:id", DeleteRecord(dao))
+	group.POST(path+"/batch", BatchRecords(dao))
+
+	documentResource[T](DefaultSpec, strings.TrimSuffix(group.BasePath(), "/")+path)
+}
+
+// GetRecord answers 304 when the If-None-Match
+// header holds the entity tag of the record.
+func GetRecord[T any](d DAO[T]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		record, etag, _, err := loadRecord(ctx.Request.Context(), d, ctx.Param("id"))
+
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		ctx.Header("ETag", etag)
+		if matchETags(ctx.GetHeader("If-None-Match"), etag, true) {
+			ctx.Status(http.StatusNotModified)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, record)
+	}
+}
+
+// CreateRecord points the Location header to the created
+// record when d is Keyed or the record Identifiable.
+func CreateRecord[T any](d DAO[T]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		var record T
+
+		if err := bindBody(ctx, &record); err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		// hooks may change the record, see Rewriter
+		if err := addRecord(ctx.Request.Context(), d, &record); err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		if id, err := recordKey(d, record); err == nil && id != "" {
+			ctx.Header("Location", strings.TrimSuffix(ctx.Request.URL.Path, "/")+"/"+url.PathEscape(id))
+		}
+		ctx.JSON(http.StatusCreated, record)
+	}
+}
+
+// ReplaceRecord answers 412 when the If-Match header does
+// not hold the entity tag of the stored record, and 501
+// when d is not Versioned.
+func ReplaceRecord[T any](d DAO[T]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		id := ctx.Param("id")
+
+		var record T
+
+		if err := bindBody(ctx, &record); err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		version, err := ifMatch(ctx, d, id)
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		etag, err := storeRecord(ctx.Request.Context(), d, id, version, &record)
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		ctx.Header("ETag", etag)
+		ctx.JSON(http.StatusOK, record)
+	}
+}
+
+// PatchRecord applies the fields present in the body
+// on top of the stored record, see ReplaceRecord for If-Match.
+func PatchRecord[T any](d DAO[T]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		id := ctx.Param("id")
+
+		header := ctx.GetHeader("If-Match")
+		if header != "" {
+			if err := conditional(d); err != nil {
+				respondError(ctx, err)
+				return
+			}
+		}
+
+		record, etag, version, err := loadRecord(ctx.Request.Context(), d, id)
+		if header == "" {
+			version = AnyVersion
+		} else {
+			version, err = matchRecord(header, id, etag, version, err)
+		}
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		patch, err := io.ReadAll(ctx.Request.Body)
+		if err == nil {
+			err = json.Unmarshal(patch, &record)
+		}
+		if err != nil {
+			respondError(ctx, &BadRequestError{Err: err})
+			return
+		}
+
+		if err := binding.Validator.ValidateStruct(&record); err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		etag, err = storeRecord(ctx.Request.Context(), d, id, version, &record)
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		ctx.Header("ETag", etag)
+		ctx.JSON(http.StatusOK, record)
+	}
+}
+
+// DeleteRecord answers 412 when the If-Match header does
+// not hold the entity tag of the stored record, and 501
+// when d is not Versioned.
+func DeleteRecord[T any](d DAO[T]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		id := ctx.Param("id")
+
+		version, err := ifMatch(ctx, d, id)
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		if err := removeRecord(ctx.Request.Context(), d, id, version); err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		ctx.Status(http.StatusNoContent)
+	}
+}
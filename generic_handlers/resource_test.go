@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testUser struct {
+	Username string `json:"username"`
+	Active   bool   `json:"active"`
+}
+
+func newTestRouter(dao DAO[testUser]) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(&r.RouterGroup, "/users", dao)
+	return r
+}
+
+func newTestUsers() *SliceDb[testUser] {
+	return &SliceDb[testUser]{
+		Key: func(u testUser) string { return u.Username },
+		Db: []testUser{
+			{Username: "Adam", Active: false},
+			{Username: "Eve", Active: true},
+		},
+	}
+}
+
+func do(r http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestResourceCRUD(t *testing.T) {
+	users := newTestUsers()
+	r := newTestRouter(users)
+
+	steps := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/users/Eve", "", http.StatusOK},
+		{"GET", "/users/Nobody", "", http.StatusNotFound},
+		{"POST", "/users", `{"username":"Bob","active":true}`, http.StatusCreated},
+		{"POST", "/users", `{"username":"Bob"}`, http.StatusConflict},
+		{"POST", "/users", `{"username":`, http.StatusBadRequest},
+		{"PUT", "/users/Bob", `{"username":"Bob","active":false}`, http.StatusOK},
+		{"PUT", "/users/Nobody", `{"username":"Nobody"}`, http.StatusNotFound},
+		{"PATCH", "/users/Adam", `{"active":true}`, http.StatusOK},
+		{"DELETE", "/users/Eve", "", http.StatusNoContent},
+		{"DELETE", "/users/Eve", "", http.StatusNotFound},
+	}
+
+	for _, s := range steps {
+		w := do(r, s.method, s.path, s.body)
+		if w.Code != s.status {
+			t.Fatalf("%s %s: status %d, want %d: %s", s.method, s.path, w.Code, s.status, w.Body)
+		}
+	}
+
+	w := do(r, "GET", "/users", "")
+	got := []testUser{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []testUser{{"Adam", true}, {"Bob", false}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCreateRecordLocation(t *testing.T) {
+	users := newTestUsers()
+	r := newTestRouter(WithHooks[testUser](users, Hooks[testUser]{}))
+
+	for _, name := range []string{"Bob", "Ann Lee"} {
+		w := do(r, "POST", "/users", `{"username":"`+name+`","active":true}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("POST %s: status %d: %s", name, w.Code, w.Body)
+		}
+
+		location := w.Header().Get("Location")
+		if want := "/users/" + strings.ReplaceAll(name, " ", "%20"); location != want {
+			t.Errorf("Location %q, want %q", location, want)
+		}
+
+		got := testUser{}
+		w = do(r, "GET", location, "")
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got != (testUser{name, true}) {
+			t.Errorf("GET %s: %d %s", location, w.Code, w.Body)
+		}
+	}
+}
+
+func TestResourceWrites(t *testing.T) {
+	r := newTestRouter(newTestUsers())
+
+	if w := do(r, "PUT", "/users/Adam", `{"username":"Adam","active":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status %d: %s", w.Code, w.Body)
+	}
+	got := testUser{}
+	json.Unmarshal(do(r, "GET", "/users/Adam", "").Body.Bytes(), &got)
+	if !got.Active {
+		t.Errorf("update not stored: %+v", got)
+	}
+
+	if w := do(r, "DELETE", "/users/Adam", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d: %s", w.Code, w.Body)
+	}
+	if w := do(r, "GET", "/users/Adam", ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted record: status %d", w.Code)
+	}
+	if w := do(r, "GET", "/users/Eve", ""); w.Code != http.StatusOK {
+		t.Errorf("other record: status %d", w.Code)
+	}
+}
+
+func TestSliceDbConcurrentAccess(t *testing.T) {
+	users := &SliceDb[testUser]{Key: func(u testUser) string { return u.Username }}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			users.Add(context.Background(), testUser{Username: fmt.Sprint("user", i)})
+		}()
+		go func() {
+			defer wg.Done()
+			users.Dump(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	all, _ := users.Dump(context.Background())
+	if len(all) != 50 {
+		t.Errorf("%d users, want 50", len(all))
+	}
+}
+
+// slowUsers never answers before the request context is done.
+type slowUsers struct {
+	*SliceDb[testUser]
+}
+
+func (s slowUsers) Dump(ctx context.Context) ([]testUser, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterResource(r.Group("", Timeout(10*time.Millisecond)), "/users", slowUsers{newTestUsers()})
+
+	w := do(r, "GET", "/users", "")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504: %s", w.Code, w.Body)
+	}
+}
@@ -1,35 +1,427 @@
 package main
 
-type QueryFunc[T any] func() ([]T, error)
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
 
+// NotFoundError is returned by a DAO when no record has the requested ID.
+type NotFoundError struct {
+	ID string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("record %q not found", e.ID)
+}
+
+// ConflictError is returned by a DAO when a record with the same ID
+// already exists.
+type ConflictError struct {
+	ID string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("record %q already exists", e.ID)
+}
+
+// PreconditionFailedError is returned by a Versioned DAO when
+// a conditional write finds the record at another version, or
+// at AnyVersion when the record does not exist.
+type PreconditionFailedError struct {
+	ID      string
+	Version uint64
+}
+
+func (e *PreconditionFailedError) Error() string {
+	if e.Version == AnyVersion {
+		return fmt.Sprintf("record %q does not exist", e.ID)
+	}
+	return fmt.Sprintf("record %q is at version %d", e.ID, e.Version)
+}
+
+// QueryFunc selects records, it should give up once ctx is done.
+type QueryFunc[T any] func(ctx context.Context) ([]T, error)
+
+// DAO stores records of type T. Every method takes the context of
+// the request it serves and returns ctx.Err() once it is done.
 type DAO[T any] interface {
-	Add(T) error
-	Get(QueryFunc[T]) ([]T, error)
-	Update(string, T) error
-	Delete(string) error
+	Add(context.Context, T) error
+	Get(context.Context, QueryFunc[T]) ([]T, error)
+	GetByID(context.Context, string) (T, error)
+	Dump(context.Context) ([]T, error)
+	Update(context.Context, string, T) error
+	Delete(context.Context, string) error
+}
+
+// AnyVersion makes the writes of a Versioned DAO unconditional.
+const AnyVersion uint64 = 0
+
+// Versioned DAOs keep a version per record, bumped by every write,
+// so that writes can be made conditional. Writes at a version other
+// than AnyVersion fail with a PreconditionFailedError when the
+// record moved on.
+type Versioned[T any] interface {
+	GetVersion(ctx context.Context, id string) (T, uint64, error)
+	UpdateVersion(ctx context.Context, id string, version uint64, data T) (uint64, error)
+	DeleteVersion(ctx context.Context, id string, version uint64) error
+}
+
+// Identifiable records know their own ID.
+type Identifiable interface {
+	ID() string
+}
+
+// Keyed DAOs tell the ID they store a record under.
+type Keyed[T any] interface {
+	KeyOf(record T) (string, error)
+}
+
+// Rewriter DAOs may store other records than the ones they are
+// given, like the DAOs WithHooks returns. Their writes leave the
+// stored record in *record, as Batch does in the records of its
+// operations. UpdateRecord writes at version like Versioned DAOs,
+// the others ignore it.
+type Rewriter[T any] interface {
+	AddRecord(ctx context.Context, record *T) error
+	UpdateRecord(ctx context.Context, id string, version uint64, record *T) (uint64, error)
+}
+
+// addRecord adds record to d, leaving the stored record in it.
+func addRecord[T any](ctx context.Context, d DAO[T], record *T) error {
+	if r, ok := d.(Rewriter[T]); ok {
+		return r.AddRecord(ctx, record)
+	}
+	return d.Add(ctx, *record)
+}
+
+// updateRecord replaces the record id of d at version, see
+// Versioned, leaving the stored record in record. It returns
+// the new version, AnyVersion when d is not Versioned.
+func updateRecord[T any](ctx context.Context, d DAO[T], id string, version uint64, record *T) (uint64, error) {
+	if r, ok := d.(Rewriter[T]); ok {
+		return r.UpdateRecord(ctx, id, version, record)
+	}
+	if v, ok := d.(Versioned[T]); ok {
+		return v.UpdateVersion(ctx, id, version, *record)
+	}
+	return AnyVersion, d.Update(ctx, id, *record)
+}
+
+// recordKey returns the ID d stores record under.
+func recordKey[T any](d DAO[T], record T) (string, error) {
+	if k, ok := d.(Keyed[T]); ok {
+		return k.KeyOf(record)
+	}
+	if r, ok := any(record).(Identifiable); ok {
+		return r.ID(), nil
+	}
+	return "", fmt.Errorf("%T has no ID", record)
+}
+
+// keyOf returns the ID of record, given by key when it is set,
+// option names key in the error when record has no ID.
+func keyOf[T any](key func(T) string, record T, option string) (string, error) {
+	if key != nil {
+		return key(record), nil
+	}
+
+	if r, ok := any(record).(Identifiable); ok {
+		return r.ID(), nil
+	}
+
+	return "", fmt.Errorf("%T has no ID, set %s or implement Identifiable", record, option)
+}
+
+// runQuery runs q unless ctx is done.
+func runQuery[T any](ctx context.Context, q QueryFunc[T]) ([]T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return q(ctx)
 }
 
+// getByID returns the record id of v, without its version.
+func getByID[T any](ctx context.Context, v Versioned[T], id string) (T, error) {
+	record, _, err := v.GetVersion(ctx, id)
+	return record, err
+}
+
+// scan returns the records kept by keep, skipping the positions
+// live reports deleted when it is set. Long scans stop when ctx
+// is done.
+func scan[T any](ctx context.Context, records []T, live func(int) bool, keep func(T) bool) ([]T, error) {
+	result := []T{}
+	for i, record := range records {
+		if i%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if (live == nil || live(i)) && keep(record) {
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
+// SliceDb is an in memory Versioned DAO, safe for concurrent use.
+// Records are identified by Key, or by their ID method
+// when they implement Identifiable.
 type SliceDb[T any] struct {
-	Db []T
+	Db  []T
+	Key func(T) string
+
+	mu sync.RWMutex
+	// versions of the records written since the start, the others
+	// are at version 1. Versions come from a single sequence so a
+	// deleted and recreated record never reuses one.
+	versions map[string]uint64
+	seq      uint64
+}
+
+func (s *SliceDb[T]) key(record T) (string, error) {
+	return keyOf(s.Key, record, "SliceDb.Key")
+}
+
+// KeyOf returns the ID of record.
+func (s *SliceDb[T]) KeyOf(record T) (string, error) {
+	return s.key(record)
+}
+
+// index returns the position of id in Db, or -1.
+// Callers must hold s.mu.
+func (s *SliceDb[T]) index(id string) (int, error) {
+	for i, record := range s.Db {
+		key, err := s.key(record)
+		if err != nil {
+			return -1, err
+		}
+		if key == id {
+			return i, nil
+		}
+	}
+	return -1, nil
 }
 
-func (s *SliceDb[T]) Add(record T) error {
+func (s *SliceDb[T]) Add(ctx context.Context, record T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := s.key(record)
+	if err != nil {
+		return err
+	}
+
+	i, err := s.index(id)
+	if err != nil {
+		return err
+	}
+	if i >= 0 {
+		return &ConflictError{ID: id}
+	}
+
 	s.Db = append(s.Db, record)
+	s.setVersion(id, s.nextVersion())
 	return nil
 }
 
-func (s *SliceDb[T]) Update(id string, data T) error {
-	return nil
+// version returns the version of id. Callers must hold s.mu.
+func (s *SliceDb[T]) version(id string) uint64 {
+	if v, ok := s.versions[id]; ok {
+		return v
+	}
+	return 1
+}
+
+// nextVersion returns a version never used before.
+// Callers must hold s.mu for writing.
+func (s *SliceDb[T]) nextVersion() uint64 {
+	s.seq = max(s.seq, 1) + 1
+	return s.seq
+}
+
+// setVersion records the version of id, 0 forgets it.
+// Callers must hold s.mu for writing.
+func (s *SliceDb[T]) setVersion(id string, version uint64) {
+	if s.versions == nil {
+		s.versions = map[string]uint64{}
+	}
+
+	if version == 0 {
+		delete(s.versions, id)
+		return
+	}
+	s.versions[id] = version
 }
 
-func (s *SliceDb[T]) Get(q QueryFunc[T]) ([]T, error) {
-	return q()
+func (s *SliceDb[T]) Update(ctx context.Context, id string, data T) error {
+	_, err := s.UpdateVersion(ctx, id, AnyVersion, data)
+	return err
 }
 
-func (s *SliceDb[T]) Delete(id string) error {
+// UpdateVersion replaces the record id when it is at version,
+// and returns its new version.
+func (s *SliceDb[T]) UpdateVersion(ctx context.Context, id string, version uint64, data T) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.index(id)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, &NotFoundError{ID: id}
+	}
+
+	current := s.version(id)
+	if version != AnyVersion && version != current {
+		return 0, &PreconditionFailedError{ID: id, Version: current}
+	}
+
+	// the update may change the ID, it must stay unique
+	newID, err := s.key(data)
+	if err != nil {
+		return 0, err
+	}
+	if newID != id {
+		j, err := s.index(newID)
+		if err != nil {
+			return 0, err
+		}
+		if j >= 0 {
+			return 0, &ConflictError{ID: newID}
+		}
+		s.setVersion(id, 0)
+	}
+
+	next := s.nextVersion()
+	s.Db[i] = data
+	s.setVersion(newID, next)
+	return next, nil
+}
+
+// Get runs q. Queries read the records through Dump or
+// Filter, which take the lock, and not through Db.
+func (s *SliceDb[T]) Get(ctx context.Context, q QueryFunc[T]) ([]T, error) {
+	return runQuery(ctx, q)
+}
+
+func (s *SliceDb[T]) GetByID(ctx context.Context, id string) (T, error) {
+	return getByID[T](ctx, s, id)
+}
+
+// GetVersion returns the record id with its version.
+func (s *SliceDb[T]) GetVersion(ctx context.Context, id string) (T, uint64, error) {
+	var record T
+
+	if err := ctx.Err(); err != nil {
+		return record, 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, err := s.index(id)
+	if err != nil {
+		return record, 0, err
+	}
+	if i < 0 {
+		return record, 0, &NotFoundError{ID: id}
+	}
+
+	return s.Db[i], s.version(id), nil
+}
+
+func (s *SliceDb[T]) Delete(ctx context.Context, id string) error {
+	return s.DeleteVersion(ctx, id, AnyVersion)
+}
+
+// DeleteVersion deletes the record id when it is at version.
+func (s *SliceDb[T]) DeleteVersion(ctx context.Context, id string, version uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.index(id)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		return &NotFoundError{ID: id}
+	}
+
+	if current := s.version(id); version != AnyVersion && version != current {
+		return &PreconditionFailedError{ID: id, Version: current}
+	}
+
+	s.Db = slices.Delete(s.Db, i, i+1)
+	s.setVersion(id, 0)
+	return nil
+}
+
+// Batch applies ops all or nothing. They run one after the other on
+// a copy of the records, which replaces them once every operation
+// succeeded. On the first failure the copy is dropped, the records
+// are left as they were.
+func (s *SliceDb[T]) Batch(ctx context.Context, ops []BatchOp[T]) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &SliceDb[T]{
+		Db:       slices.Clone(s.Db),
+		Key:      s.Key,
+		versions: maps.Clone(s.versions),
+		seq:      s.seq,
+	}
+
+	for i, op := range ops {
+		if err := applyBatchOp[T](ctx, tx, op); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+
+	s.Db, s.versions, s.seq = tx.Db, tx.versions, tx.seq
 	return nil
 }
 
-func (s *SliceDb[T]) Dump() ([]T, error) {
-	return s.Db, nil
+// Dump returns a copy of every record.
+func (s *SliceDb[T]) Dump(ctx context.Context) ([]T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.Db), nil
+}
+
+// Filter returns a query selecting the records matching keep.
+// Long scans stop when ctx is done.
+func (s *SliceDb[T]) Filter(keep func(T) bool) QueryFunc[T] {
+	return func(ctx context.Context) ([]T, error) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		return scan(ctx, s.Db, nil, keep)
+	}
 }
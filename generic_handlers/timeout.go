@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Timeout bounds the context of the requests it handles, DAO calls
+// past the deadline fail and the handlers answer 504. Use it on a
+// single route or on a group:
+//
+//	r.GET("/report", Timeout(30*time.Second), report)
+//	RegisterResource(r.Group("", Timeout(2*time.Second)), "/users", &users)
+func Timeout(d time.Duration) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		c, cancel := context.WithTimeout(ctx.Request.Context(), d)
+		defer cancel()
+
+		ctx.Request = ctx.Request.WithContext(c)
+		ctx.Next()
+	}
+}
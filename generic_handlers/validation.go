@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Request bodies are validated with the binding tags of T, on top
+// of the validator rules like required, min or max there are:
+//
+//	regex=^[a-z]+$    the text matches the expression
+//	enum=admin user   the value is one of a space separated list
+//
+// Commas separate rules and pipes alternatives, so an expression
+// writes them 0x2C and 0x7C: regex=^(a0x7Cb)0x2C?$ is ^(a|b),?$.
+// A bare pipe would end the expression and start another rule.
+func init() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+
+	// Report fields by the name clients send them with.
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch name {
+		case "-":
+			return ""
+		case "":
+			return f.Name
+		}
+		return name
+	})
+
+	v.RegisterValidation("regex", validateRegex)
+	v.RegisterValidation("enum", validateEnum)
+}
+
+// regexps caches the compiled expressions of regex tags by their
+// decoded text, and the errors of those that do not compile.
+// checkRegexTags fills it when the type is registered, so that
+// validateRegex finds every expression compiled.
+var regexps sync.Map
+
+type compiledRegex struct {
+	re  *regexp.Regexp
+	err error
+}
+
+// tagParam decodes the parameter of a binding rule the way the
+// validator does before handing it to validateRegex as fl.Param().
+func tagParam(raw string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(raw, "0x2C", ","), "0x7C", "|")
+}
+
+// compileRegex returns the cached expression expr, compiling it
+// on first use.
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	c, ok := regexps.Load(expr)
+	if !ok {
+		re, err := regexp.Compile(expr)
+		c, _ = regexps.LoadOrStore(expr, compiledRegex{re, err})
+	}
+	return c.(compiledRegex).re, c.(compiledRegex).err
+}
+
+// validateRegex fails fields whose expression does not compile,
+// checkRegexTags catches those when the type is registered. The
+// expressions of types wired without RegisterResource are compiled
+// on their first validation.
+func validateRegex(fl validator.FieldLevel) bool {
+	re, err := compileRegex(fl.Param())
+	if err != nil {
+		log.Printf("invalid regex %q on field %s: %v", fl.Param(), fl.StructFieldName(), err)
+		return false
+	}
+
+	return re.MatchString(fmt.Sprint(fl.Field().Interface()))
+}
+
+// checkRegexTags compiles the regex binding tags of t and of the
+// structs it holds into regexps.
+func checkRegexTags(t reflect.Type) error {
+	return walkRegexTags(t, map[reflect.Type]bool{})
+}
+
+func walkRegexTags(t reflect.Type, seen map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() {
+			continue
+		}
+
+		for _, rule := range strings.FieldsFunc(f.Tag.Get("binding"), func(r rune) bool { return r == ',' || r == '|' }) {
+			expr, ok := strings.CutPrefix(rule, "regex=")
+			if !ok {
+				continue
+			}
+			expr = tagParam(expr)
+			if _, err := compileRegex(expr); err != nil {
+				return fmt.Errorf("invalid regex %q on %s.%s: %v", expr, t, f.Name, err)
+			}
+		}
+
+		if err := walkRegexTags(f.Type, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateEnum(fl validator.FieldLevel) bool {
+	return slices.Contains(strings.Fields(fl.Param()), fmt.Sprint(fl.Field().Interface()))
+}
+
+// bindBody decodes and validates the JSON body of ctx into record.
+func bindBody(ctx *gin.Context, record any) error {
+	err := ctx.ShouldBindJSON(record)
+
+	var invalid validator.ValidationErrors
+	if err != nil && !errors.As(err, &invalid) {
+		return &BadRequestError{Err: err}
+	}
+
+	return err
+}